@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const bitbucketAPIBaseURL = "https://api.bitbucket.org/2.0"
+
+// BitbucketProvider reviews a Bitbucket Cloud pull request through the Bitbucket REST API.
+// It authenticates with an access token, or with a username and app password.
+type BitbucketProvider struct {
+	Token       string
+	Username    string
+	AppPassword string
+	BaseURL     string
+	Workspace   string
+	RepoSlug    string
+	PullID      int
+	HTTPClient  *http.Client
+
+	Title       string
+	Description string
+}
+
+// newBitbucketProviderFromEnv creates a provider for the pull request of the current Bitbucket
+// Pipelines build, from the credential inputs and the default pipeline variables, and loads its details
+func newBitbucketProviderFromEnv(ctx context.Context, httpClient *http.Client) (*BitbucketProvider, error) {
+	provider := &BitbucketProvider{
+		Token:       os.Getenv("INPUT_BITBUCKET_TOKEN"),
+		Username:    os.Getenv("INPUT_BITBUCKET_USERNAME"),
+		AppPassword: os.Getenv("INPUT_BITBUCKET_APP_PASSWORD"),
+		BaseURL:     bitbucketAPIBaseURL,
+		Workspace:   os.Getenv("BITBUCKET_WORKSPACE"),
+		RepoSlug:    os.Getenv("BITBUCKET_REPO_SLUG"),
+		HTTPClient:  httpClient,
+	}
+	if provider.Token == "" && (provider.Username == "" || provider.AppPassword == "") {
+		return nil, configErrorf("set INPUT_BITBUCKET_TOKEN, or INPUT_BITBUCKET_USERNAME and INPUT_BITBUCKET_APP_PASSWORD")
+	}
+	pullID, err := strconv.Atoi(os.Getenv("BITBUCKET_PR_ID"))
+	if provider.Workspace == "" || provider.RepoSlug == "" || err != nil {
+		return nil, configErrorf("BITBUCKET_WORKSPACE, BITBUCKET_REPO_SLUG and BITBUCKET_PR_ID must be set, run the step in a pull request pipeline")
+	}
+	provider.PullID = pullID
+
+	if err := provider.loadPullRequest(ctx); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// pullRequestURL returns the API URL of the pull request, followed by path
+func (p *BitbucketProvider) pullRequestURL(path string) string {
+	return fmt.Sprintf("%s/repositories/%s/%s/pullrequests/%d%s", p.BaseURL, url.PathEscape(p.Workspace), url.PathEscape(p.RepoSlug), p.PullID, path)
+}
+
+// loadPullRequest fetches the title and description of the pull request
+func (p *BitbucketProvider) loadPullRequest(ctx context.Context) error {
+	var pr struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	}
+	data, err := p.do(ctx, "GET", p.pullRequestURL(""), nil, http.StatusOK)
+	if err == nil {
+		err = json.Unmarshal(data, &pr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch pull request: %v", err)
+	}
+	p.Title = pr.Title
+	p.Description = pr.Description
+	return nil
+}
+
+// FetchDiff fetches the pull request diff, which Bitbucket serves as a git diff
+func (p *BitbucketProvider) FetchDiff(ctx context.Context) (string, error) {
+	data, err := p.do(ctx, "GET", p.pullRequestURL("/diff"), nil, http.StatusOK)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch pull request diff: %v", err)
+	}
+	return string(data), nil
+}
+
+// PostReview posts the body as a pull request comment and each comment inline on its lines
+func (p *BitbucketProvider) PostReview(ctx context.Context, body string, comments []Comment) error {
+	comments = addReviewMarker(comments)
+	if body != "" {
+		if err := p.postComment(ctx, body, nil); err != nil {
+			return err
+		}
+	}
+
+	for _, comment := range comments {
+		if err := p.postComment(ctx, comment.Body, bitbucketInline(comment)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bitbucketInline anchors a comment on its line, "from" in the old file and "to" in the new one.
+// A multi-line comment also sets the line its range starts on.
+func bitbucketInline(comment Comment) map[string]interface{} {
+	inline := map[string]interface{}{"path": comment.Path}
+	if comment.Side == SideLeft {
+		inline["from"] = comment.Line
+	} else {
+		inline["to"] = comment.Line
+	}
+	if comment.StartLine > 0 && comment.StartLine != comment.Line {
+		if comment.StartSide == SideLeft {
+			inline["start_from"] = comment.StartLine
+		} else {
+			inline["start_to"] = comment.StartLine
+		}
+	}
+	return inline
+}
+
+// postComment adds a pull request comment, inline on a line when inline is set
+func (p *BitbucketProvider) postComment(ctx context.Context, body string, inline map[string]interface{}) error {
+	payload := map[string]interface{}{
+		"content": map[string]string{"raw": body},
+	}
+	if inline != nil {
+		payload["inline"] = inline
+	}
+	if _, err := p.do(ctx, "POST", p.pullRequestURL("/comments"), payload, http.StatusCreated); err != nil {
+		return fmt.Errorf("failed to post pull request comment: %v", err)
+	}
+	return nil
+}
+
+// do sends an authenticated request with an optional JSON body and returns the response body
+func (p *BitbucketProvider) do(ctx context.Context, method, url string, payload interface{}, wantStatus int) ([]byte, error) {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewBuffer(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	} else {
+		req.SetBasicAuth(p.Username, p.AppPassword)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != wantStatus {
+		return nil, fmt.Errorf("Bitbucket API returned %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBitbucketInline(t *testing.T) {
+	tests := []struct {
+		name    string
+		comment Comment
+		want    map[string]interface{}
+	}{
+		{"added line", Comment{Path: "a.go", Line: 4, Side: SideRight}, map[string]interface{}{"path": "a.go", "to": 4}},
+		{"removed line", Comment{Path: "a.go", Line: 4, Side: SideLeft}, map[string]interface{}{"path": "a.go", "from": 4}},
+		{
+			name:    "range",
+			comment: Comment{Path: "a.go", StartLine: 2, StartSide: SideRight, Line: 4, Side: SideRight},
+			want:    map[string]interface{}{"path": "a.go", "start_to": 2, "to": 4},
+		},
+		{
+			name:    "range over removed lines",
+			comment: Comment{Path: "a.go", StartLine: 2, StartSide: SideLeft, Line: 3, Side: SideLeft},
+			want:    map[string]interface{}{"path": "a.go", "start_from": 2, "from": 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bitbucketInline(tt.comment); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bitbucketInline() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBitbucketProvider(t *testing.T) {
+	const pr = "/repositories/team/app/pullrequests/9"
+	var posted []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "bot" || password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET " + pr:
+			w.Write([]byte(`{"title":"Add feature","description":"Details"}`))
+		case "GET " + pr + "/diff":
+			w.Write([]byte(sampleDiff))
+		case "POST " + pr + "/comments":
+			var payload map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&payload)
+			posted = append(posted, payload)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	provider := &BitbucketProvider{
+		Username:    "bot",
+		AppPassword: "secret",
+		BaseURL:     srv.URL,
+		Workspace:   "team",
+		RepoSlug:    "app",
+		PullID:      9,
+		HTTPClient:  srv.Client(),
+	}
+	ctx := context.Background()
+	if err := provider.loadPullRequest(ctx); err != nil {
+		t.Fatalf("loadPullRequest: %v", err)
+	}
+	if provider.Title != "Add feature" || provider.Description != "Details" {
+		t.Errorf("Title, Description = %q, %q", provider.Title, provider.Description)
+	}
+	diff, err := provider.FetchDiff(ctx)
+	if err != nil || diff != sampleDiff {
+		t.Fatalf("FetchDiff() = %q, %v", diff, err)
+	}
+
+	comments := []Comment{{Path: "main.go", StartLine: 9, StartSide: SideRight, Line: 10, Side: SideRight, Body: "**Info:** x"}}
+	if err := provider.PostReview(ctx, "Summary", comments); err != nil {
+		t.Fatalf("PostReview: %v", err)
+	}
+	if len(posted) != 2 {
+		t.Fatalf("posted %d comments, want 2", len(posted))
+	}
+	if _, ok := posted[0]["inline"]; ok || posted[0]["content"].(map[string]interface{})["raw"] != "Summary" {
+		t.Errorf("summary comment = %v", posted[0])
+	}
+	inline := posted[1]["inline"].(map[string]interface{})
+	want := map[string]interface{}{"path": "main.go", "start_to": float64(9), "to": float64(10)}
+	if !reflect.DeepEqual(inline, want) {
+		t.Errorf("inline = %v, want %v", inline, want)
+	}
+	if raw := posted[1]["content"].(map[string]interface{})["raw"].(string); !strings.HasPrefix(raw, "**Info:** x") || !hasReviewMarker(raw) {
+		t.Errorf("inline comment = %q, want the comment with its marker", raw)
+	}
+
+	provider.AppPassword = "wrong"
+	if err := provider.loadPullRequest(ctx); err == nil || !strings.Contains(err.Error(), "Bitbucket API returned 401") {
+		t.Errorf("err = %v, want the 401 reported", err)
+	}
+}
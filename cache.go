@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// reviewCache stores Gemini comment bodies on disk, keyed by a hash of the model and prompt,
+// so re-runs on the same PR don't re-send unchanged hunks
+type reviewCache struct {
+	dir string
+	ttl time.Duration
+}
+
+type cacheEntry struct {
+	CreatedAt time.Time `json:"created_at"`
+	Bodies    []string  `json:"bodies"`
+}
+
+// newReviewCache creates the cache directory. An empty dir disables caching and returns nil.
+func newReviewCache(dir string, ttl time.Duration) (*reviewCache, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	return &reviewCache{dir: dir, ttl: ttl}, nil
+}
+
+// cacheKey hashes everything that influences Gemini's answer for a hunk.
+// The prompt already contains the hunk content.
+func cacheKey(modelName, systemInstruction, prompt string) string {
+	hash := sha256.New()
+	for _, part := range []string{modelName, systemInstruction, prompt} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (c *reviewCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// Get returns the cached bodies for key, ignoring missing, unreadable and expired entries
+func (c *reviewCache) Get(key string) ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	if c.ttl > 0 && time.Since(entry.CreatedAt) > c.ttl {
+		return nil, false
+	}
+	return entry.Bodies, true
+}
+
+// Put stores bodies under key. Failures only log a warning since the cache is an optimization.
+func (c *reviewCache) Put(key string, bodies []string) {
+	if c == nil {
+		return
+	}
+	data, err := json.Marshal(cacheEntry{CreatedAt: time.Now(), Bodies: bodies})
+	if err == nil {
+		err = os.WriteFile(c.path(key), data, 0o644)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to write cache entry: %v\n", err)
+	}
+}
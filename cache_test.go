@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReviewCache(t *testing.T) {
+	cache, err := newReviewCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("newReviewCache: %v", err)
+	}
+	key := cacheKey("pro", "system", "prompt")
+	if _, ok := cache.Get(key); ok {
+		t.Fatal("Get() hit on an empty cache")
+	}
+	cache.Put(key, []string{"[]"})
+	if bodies, ok := cache.Get(key); !ok || !reflect.DeepEqual(bodies, []string{"[]"}) {
+		t.Errorf("Get() = %q, %v, want the stored bodies", bodies, ok)
+	}
+
+	// Everything that changes the answer changes the key
+	for _, other := range []string{cacheKey("flash", "system", "prompt"), cacheKey("pro", "other", "prompt"), cacheKey("pro", "system", "other")} {
+		if other == key {
+			t.Errorf("cacheKey collision on %s", other)
+		}
+	}
+}
+
+func TestReviewCacheExpired(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := newReviewCache(dir, time.Hour)
+	if err != nil {
+		t.Fatalf("newReviewCache: %v", err)
+	}
+	key := cacheKey("pro", "", "prompt")
+	cache.Put(key, []string{"[]"})
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.WriteFile(cache.path(key), []byte(`{"created_at":"`+old.Format(time.RFC3339)+`","bodies":["[]"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get(key); ok {
+		t.Error("Get() hit on an expired entry")
+	}
+}
+
+func TestReviewCacheDisabled(t *testing.T) {
+	cache, err := newReviewCache("", time.Hour)
+	if err != nil || cache != nil {
+		t.Fatalf("newReviewCache(\"\") = %v, %v, want nil, nil", cache, err)
+	}
+	cache.Put("key", []string{"[]"})
+	if _, ok := cache.Get("key"); ok {
+		t.Error("Get() hit on a disabled cache")
+	}
+}
+
+func TestAnalyzeCodeUsesCache(t *testing.T) {
+	files, err := parseDiff(sampleDiff)
+	if err != nil {
+		t.Fatalf("parseDiff: %v", err)
+	}
+	reviewer, gemini := newTestReviewer(t, "pro", map[string]fakeModel{"pro": {text: `[{"severity":"info","comment":"Nit","line":9}]`}})
+	if reviewer.Cache, err = newReviewCache(t.TempDir(), time.Hour); err != nil {
+		t.Fatalf("newReviewCache: %v", err)
+	}
+
+	first, err := reviewer.analyzeCodeUsingGemini(context.Background(), files, "title", "")
+	if err != nil {
+		t.Fatalf("first review: %v", err)
+	}
+	misses := gemini.totalCalls()
+	second, err := reviewer.analyzeCodeUsingGemini(context.Background(), files, "title", "")
+	if err != nil {
+		t.Fatalf("second review: %v", err)
+	}
+	if misses != 3 || gemini.totalCalls() != misses {
+		t.Errorf("Gemini calls = %d then %d, want 3 misses then only hits", misses, gemini.totalCalls())
+	}
+	sortComments(first)
+	sortComments(second)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("cached review = %+v, want %+v", second, first)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Output modes: review comments on the PR, annotations on a check run, or only a commit status
+const (
+	outputModeReview     = "review"
+	outputModeChecks     = "checks"
+	outputModeStatusOnly = "status-only"
+)
+
+const (
+	checkRunName = "Gemini review"
+	// The Checks API accepts at most 50 annotations per request
+	maxAnnotationsPerRequest = 50
+)
+
+// Annotation is a Checks API annotation on lines of the head commit
+type Annotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Message         string `json:"message"`
+}
+
+// parseOutputMode validates INPUT_OUTPUT_MODE, defaulting to review comments
+func parseOutputMode(value string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(value)); mode {
+	case "", outputModeReview:
+		return outputModeReview, nil
+	case outputModeChecks:
+		return outputModeChecks, nil
+	case outputModeStatusOnly:
+		return outputModeStatusOnly, nil
+	default:
+		return "", fmt.Errorf("invalid output mode %q (expected %q, %q or %q)", value, outputModeReview, outputModeChecks, outputModeStatusOnly)
+	}
+}
+
+// Checks annotation levels, from least to most severe
+const (
+	annotationLevelNotice  = "notice"
+	annotationLevelWarning = "warning"
+	annotationLevelFailure = "failure"
+)
+
+// defaultAnnotationLevels maps finding severities to annotation levels
+var defaultAnnotationLevels = map[string]string{
+	SeverityCritical: annotationLevelFailure,
+	SeverityWarning:  annotationLevelWarning,
+	SeverityInfo:     annotationLevelNotice,
+}
+
+// parseAnnotationLevels reads overrides of the default mapping, as "severity: level" pairs
+// separated by commas or newlines, e.g. "critical: warning, info: warning"
+func parseAnnotationLevels(value string) (map[string]string, error) {
+	levels := map[string]string{}
+	for severity, level := range defaultAnnotationLevels {
+		levels[severity] = level
+	}
+	for _, item := range parseListInput(value) {
+		severity, level, found := strings.Cut(item, ":")
+		severity = strings.ToLower(strings.TrimSpace(severity))
+		level = strings.ToLower(strings.TrimSpace(level))
+		if !found {
+			return nil, fmt.Errorf("invalid annotation level mapping %q, expected \"severity: level\"", item)
+		}
+		if _, known := defaultAnnotationLevels[severity]; !known {
+			return nil, fmt.Errorf("unknown severity %q in annotation level mapping", severity)
+		}
+		if annotationLevelRank(level) < 0 {
+			return nil, fmt.Errorf("invalid annotation level %q (expected %s, %s or %s)", level, annotationLevelNotice, annotationLevelWarning, annotationLevelFailure)
+		}
+		levels[severity] = level
+	}
+	return levels, nil
+}
+
+// annotationLevelRank orders annotation levels, -1 for unknown ones
+func annotationLevelRank(level string) int {
+	switch level {
+	case annotationLevelNotice:
+		return 0
+	case annotationLevelWarning:
+		return 1
+	case annotationLevelFailure:
+		return 2
+	default:
+		return -1
+	}
+}
+
+// annotationLevel maps a finding severity to an annotation level, notice when unmapped
+func annotationLevel(levels map[string]string, severity string) string {
+	if level, ok := levels[severity]; ok {
+		return level
+	}
+	return annotationLevelNotice
+}
+
+// Check run conclusions. Reviews that didn't cover the whole PR are concluded by the caller:
+// neutral when part of it was left out, failure when the review itself failed.
+const (
+	conclusionSuccess = "success"
+	conclusionNeutral = "neutral"
+	conclusionFailure = "failure"
+)
+
+// conclusionRank orders conclusions, higher is worse
+func conclusionRank(conclusion string) int {
+	switch conclusion {
+	case conclusionFailure:
+		return 2
+	case conclusionNeutral:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// checkConclusion derives the check run conclusion from the most severe annotation level:
+// failure fails the check, warning makes it neutral, and notices alone still succeed
+func checkConclusion(levels map[string]string, comments []Comment) string {
+	highest := -1
+	for _, comment := range comments {
+		if rank := annotationLevelRank(annotationLevel(levels, comment.Severity)); rank > highest {
+			highest = rank
+		}
+	}
+	switch highest {
+	case annotationLevelRank(annotationLevelFailure):
+		return conclusionFailure
+	case annotationLevelRank(annotationLevelWarning):
+		return conclusionNeutral
+	default:
+		return conclusionSuccess
+	}
+}
+
+// commentsToAnnotations converts review comments to annotations. Annotations can only
+// target the head commit, so comments on removed lines are left out.
+func commentsToAnnotations(levels map[string]string, comments []Comment) []Annotation {
+	var annotations []Annotation
+	for _, comment := range comments {
+		if comment.Side == SideLeft || comment.Line == 0 {
+			continue
+		}
+		startLine := comment.StartLine
+		if startLine == 0 {
+			startLine = comment.Line
+		}
+		annotations = append(annotations, Annotation{
+			Path:            comment.Path,
+			StartLine:       startLine,
+			EndLine:         comment.Line,
+			AnnotationLevel: annotationLevel(levels, comment.Severity),
+			Message:         comment.Body,
+		})
+	}
+	return annotations
+}
+
+// checkRunOutput is the output section of a check run
+type checkRunOutput struct {
+	Title       string       `json:"title"`
+	Summary     string       `json:"summary"`
+	Annotations []Annotation `json:"annotations,omitempty"`
+}
+
+// createCheckRun reports the findings as a completed check run on headSHA. Annotations past
+// the first batch are added by updating the check run, as the API limits them per request.
+func (c *GitHubClient) createCheckRun(ctx context.Context, owner, repo, headSHA, conclusion, summary string, annotations []Annotation) error {
+	if headSHA == "" {
+		return fmt.Errorf("the head commit is unknown, can't create a check run")
+	}
+
+	batch := func(i int) []Annotation {
+		end := i + maxAnnotationsPerRequest
+		if end > len(annotations) {
+			end = len(annotations)
+		}
+		return annotations[i:end]
+	}
+
+	url := fmt.Sprintf("%s/repos/%s/%s/check-runs", c.BaseURL, owner, repo)
+	payload := map[string]interface{}{
+		"name":       checkRunName,
+		"head_sha":   headSHA,
+		"status":     "completed",
+		"conclusion": conclusion,
+		"output": checkRunOutput{
+			Title:       checkRunName,
+			Summary:     summary,
+			Annotations: batch(0),
+		},
+	}
+	var checkRun struct {
+		ID int64 `json:"id"`
+	}
+	if err := c.doJSON(ctx, "POST", url, payload, http.StatusCreated, &checkRun); err != nil {
+		return fmt.Errorf("failed to create check run: %v", err)
+	}
+
+	for i := maxAnnotationsPerRequest; i < len(annotations); i += maxAnnotationsPerRequest {
+		update := map[string]interface{}{
+			"output": checkRunOutput{
+				Title:       checkRunName,
+				Summary:     summary,
+				Annotations: batch(i),
+			},
+		}
+		if err := c.doJSON(ctx, "PATCH", fmt.Sprintf("%s/%d", url, checkRun.ID), update, http.StatusOK, nil); err != nil {
+			return fmt.Errorf("failed to add annotations to check run: %v", err)
+		}
+	}
+	return nil
+}
+
+// commitStatusState maps the check conclusion to a commit status state. Statuses have no neutral
+// state, so only failure-level findings fail the status, and an incomplete review is an error
+// rather than a success.
+func commitStatusState(conclusion string, incomplete bool) string {
+	switch {
+	case conclusion == conclusionFailure:
+		return "failure"
+	case incomplete:
+		return "error"
+	default:
+		return "success"
+	}
+}
+
+// commitStatusDescription counts the findings by severity, within the 140 characters GitHub allows
+func commitStatusDescription(comments []Comment, incomplete bool) string {
+	found := commentCounts(comments)
+	switch {
+	case incomplete && found == "":
+		return "Gemini review incomplete"
+	case incomplete:
+		return "Gemini review incomplete, found " + found
+	case found == "":
+		return "Gemini found no issues"
+	default:
+		return "Gemini found " + found
+	}
+}
+
+// commentCounts lists the number of comments per severity, e.g. "1 critical, 2 info"
+func commentCounts(comments []Comment) string {
+	counts := map[string]int{}
+	for _, comment := range comments {
+		counts[normalizeSeverity(comment.Severity)]++
+	}
+	var parts []string
+	for _, severity := range []string{SeverityCritical, SeverityWarning, SeverityInfo} {
+		if counts[severity] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[severity], severity))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// createCommitStatus sets the Gemini review commit status on sha
+func (c *GitHubClient) createCommitStatus(ctx context.Context, owner, repo, sha, state, description string) error {
+	url := fmt.Sprintf("%s/repos/%s/%s/statuses/%s", c.BaseURL, owner, repo, sha)
+	payload := map[string]string{
+		"state":       state,
+		"description": description,
+		"context":     checkRunName,
+	}
+	if err := c.doJSON(ctx, "POST", url, payload, http.StatusCreated, nil); err != nil {
+		return fmt.Errorf("failed to create commit status: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckConclusion(t *testing.T) {
+	tests := []struct {
+		name     string
+		levels   map[string]string
+		severity []string
+		want     string
+	}{
+		{"no findings", defaultAnnotationLevels, nil, conclusionSuccess},
+		{"info only", defaultAnnotationLevels, []string{SeverityInfo}, conclusionSuccess},
+		{"warning", defaultAnnotationLevels, []string{SeverityInfo, SeverityWarning}, conclusionNeutral},
+		{"critical", defaultAnnotationLevels, []string{SeverityWarning, SeverityCritical}, conclusionFailure},
+		{
+			name:     "critical lowered to a warning",
+			levels:   map[string]string{SeverityCritical: annotationLevelWarning, SeverityWarning: annotationLevelNotice, SeverityInfo: annotationLevelNotice},
+			severity: []string{SeverityCritical},
+			want:     conclusionNeutral,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var comments []Comment
+			for _, severity := range tt.severity {
+				comments = append(comments, Comment{Path: "a.go", Line: 1, Severity: severity})
+			}
+			if got := checkConclusion(tt.levels, comments); got != tt.want {
+				t.Errorf("checkConclusion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAnnotationLevels(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", defaultAnnotationLevels, false},
+		{
+			"critical: warning, Info : WARNING",
+			map[string]string{SeverityCritical: annotationLevelWarning, SeverityWarning: annotationLevelWarning, SeverityInfo: annotationLevelWarning},
+			false,
+		},
+		{"critical", nil, true},
+		{"nitpick: notice", nil, true},
+		{"critical: error", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAnnotationLevels(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseAnnotationLevels(%q) err = %v, wantErr %v", tt.value, err, tt.wantErr)
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAnnotationLevels(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+	if defaultAnnotationLevels[SeverityCritical] != annotationLevelFailure {
+		t.Error("parseAnnotationLevels changed the default mapping")
+	}
+}
+
+func TestCommentsToAnnotations(t *testing.T) {
+	comments := []Comment{
+		{Path: "a.go", Line: 5, Side: SideRight, Severity: SeverityCritical, Body: "one"},
+		{Path: "a.go", StartLine: 7, Line: 9, Side: SideRight, Severity: SeverityInfo, Body: "range"},
+		{Path: "a.go", Line: 3, Side: SideLeft, Severity: SeverityWarning, Body: "removed line"},
+	}
+	want := []Annotation{
+		{Path: "a.go", StartLine: 5, EndLine: 5, AnnotationLevel: annotationLevelFailure, Message: "one"},
+		{Path: "a.go", StartLine: 7, EndLine: 9, AnnotationLevel: annotationLevelNotice, Message: "range"},
+	}
+	if got := commentsToAnnotations(defaultAnnotationLevels, comments); !reflect.DeepEqual(got, want) {
+		t.Errorf("commentsToAnnotations() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCommitStatusState(t *testing.T) {
+	tests := []struct {
+		conclusion string
+		incomplete bool
+		want       string
+	}{
+		{conclusionSuccess, false, "success"},
+		{conclusionNeutral, false, "success"},
+		{conclusionFailure, false, "failure"},
+		{conclusionNeutral, true, "error"},
+		{conclusionFailure, true, "failure"},
+	}
+	for _, tt := range tests {
+		if got := commitStatusState(tt.conclusion, tt.incomplete); got != tt.want {
+			t.Errorf("commitStatusState(%q, %v) = %q, want %q", tt.conclusion, tt.incomplete, got, tt.want)
+		}
+	}
+}
+
+func TestCommitStatusDescription(t *testing.T) {
+	comments := []Comment{{Severity: SeverityInfo}, {Severity: SeverityCritical}, {Severity: SeverityInfo}}
+	tests := []struct {
+		name       string
+		comments   []Comment
+		incomplete bool
+		want       string
+	}{
+		{"no findings", nil, false, "Gemini found no issues"},
+		{"findings", comments, false, "Gemini found 1 critical, 2 info"},
+		{"incomplete", nil, true, "Gemini review incomplete"},
+		{"incomplete with findings", comments, true, "Gemini review incomplete, found 1 critical, 2 info"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := commitStatusDescription(tt.comments, tt.incomplete); got != tt.want {
+				t.Errorf("commitStatusDescription() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostReviewWithConclusion(t *testing.T) {
+	warning := []Comment{{Path: "a.go", Line: 9, Side: SideRight, Severity: SeverityWarning, Body: "**Warning:** x"}}
+	critical := []Comment{{Path: "a.go", Line: 9, Side: SideRight, Severity: SeverityCritical, Body: "**Critical:** x"}}
+	tests := []struct {
+		name        string
+		mode        string
+		comments    []Comment
+		conclusion  string
+		autoApprove bool
+		path        string
+		key         string
+		want        string
+	}{
+		{"checks success", outputModeChecks, nil, "", false, "/repos/o/r/check-runs", "conclusion", conclusionSuccess},
+		{"checks warning", outputModeChecks, warning, "", false, "/repos/o/r/check-runs", "conclusion", conclusionNeutral},
+		{"checks incomplete", outputModeChecks, nil, conclusionNeutral, false, "/repos/o/r/check-runs", "conclusion", conclusionNeutral},
+		{"checks incomplete keeps a failure", outputModeChecks, critical, conclusionNeutral, false, "/repos/o/r/check-runs", "conclusion", conclusionFailure},
+		{"checks failed review", outputModeChecks, nil, conclusionFailure, false, "/repos/o/r/check-runs", "conclusion", conclusionFailure},
+		{"status success", outputModeStatusOnly, warning, "", false, "/repos/o/r/statuses/head", "state", "success"},
+		{"status critical", outputModeStatusOnly, critical, "", false, "/repos/o/r/statuses/head", "state", "failure"},
+		{"status incomplete", outputModeStatusOnly, nil, conclusionNeutral, false, "/repos/o/r/statuses/head", "state", "error"},
+		{"status failed review", outputModeStatusOnly, nil, conclusionFailure, false, "/repos/o/r/statuses/head", "state", "failure"},
+		{"review approves", outputModeReview, nil, "", true, "/repos/o/r/pulls/1/reviews", "event", ReviewEventApprove},
+		{"incomplete review never approves", outputModeReview, nil, conclusionNeutral, true, "/repos/o/r/pulls/1/reviews", "event", ReviewEventComment},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeGitHub(t)
+			provider := &GitHubProvider{
+				Client:           client,
+				PR:               &PRDetails{Owner: "o", Repo: "r", PullNumber: 1, HeadSHA: "head"},
+				ReviewEventMode:  ReviewEventAuto,
+				AutoApprove:      tt.autoApprove,
+				OutputMode:       tt.mode,
+				AnnotationLevels: defaultAnnotationLevels,
+			}
+			if err := provider.PostReviewWithConclusion(context.Background(), "body", tt.comments, tt.conclusion); err != nil {
+				t.Fatalf("PostReviewWithConclusion: %v", err)
+			}
+			posts := fake.posts[tt.path]
+			if len(posts) == 0 {
+				t.Fatalf("nothing posted to %s, got %v", tt.path, fake.posts)
+			}
+			payload := posts[len(posts)-1]
+			if got := payload[tt.key]; got != tt.want {
+				t.Errorf("%s = %v, want %q", tt.key, got, tt.want)
+			}
+			if tt.mode == outputModeStatusOnly && tt.conclusion != "" &&
+				!strings.HasPrefix(payload["description"].(string), "Gemini review incomplete") {
+				t.Errorf("description = %v, want the review marked incomplete", payload["description"])
+			}
+		})
+	}
+}
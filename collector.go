@@ -0,0 +1,27 @@
+package main
+
+import "sync"
+
+// CommentCollector gathers review comments from concurrent workers, like the per-file workers of
+// analyzeCodeUsingGemini. The zero value is ready to use.
+type CommentCollector struct {
+	mu       sync.Mutex
+	comments []Comment
+}
+
+// Add appends comments to the collection, safe to call from several goroutines
+func (c *CommentCollector) Add(comments ...Comment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.comments = append(c.comments, comments...)
+}
+
+// Comments returns a copy of the comments collected so far, in the order they were added
+func (c *CommentCollector) Comments() []Comment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.comments) == 0 {
+		return nil
+	}
+	return append([]Comment(nil), c.comments...)
+}
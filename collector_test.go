@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCommentCollectorConcurrentAdd(t *testing.T) {
+	const workers, perWorker = 16, 50
+	var collector CommentCollector
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			path := fmt.Sprintf("file%d.go", w)
+			for line := 1; line <= perWorker; line++ {
+				collector.Add(Comment{Path: path, Line: line})
+				// Reading while others write must be safe too
+				_ = collector.Comments()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	comments := collector.Comments()
+	if len(comments) != workers*perWorker {
+		t.Fatalf("collected %d comments, want %d", len(comments), workers*perWorker)
+	}
+	// Each worker's comments keep their order
+	next := map[string]int{}
+	for _, comment := range comments {
+		next[comment.Path]++
+		if comment.Line != next[comment.Path] {
+			t.Fatalf("%s: got line %d, want %d", comment.Path, comment.Line, next[comment.Path])
+		}
+	}
+}
+
+func TestCommentCollectorComments(t *testing.T) {
+	var collector CommentCollector
+	if got := collector.Comments(); got != nil {
+		t.Errorf("empty collector returned %v, want nil", got)
+	}
+	collector.Add(Comment{Path: "a.go", Line: 1}, Comment{Path: "a.go", Line: 2})
+	got := collector.Comments()
+	got[0].Line = 99
+	if again := collector.Comments(); again[0].Line != 1 {
+		t.Errorf("modifying the returned slice changed the collection: %v", again)
+	}
+}
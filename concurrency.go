@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// limitedTransport lets at most cap(slots) requests be in flight at once, whichever service they
+// go to. A request holds its slot until its response body is closed, so streamed responses count
+// for as long as they are being read.
+type limitedTransport struct {
+	base  http.RoundTripper
+	slots chan struct{}
+}
+
+// newLimitedTransport wraps base to allow at most limit concurrent requests, or returns base
+// unchanged when limit is 0 or less
+func newLimitedTransport(base http.RoundTripper, limit int) http.RoundTripper {
+	if limit <= 0 {
+		return base
+	}
+	return &limitedTransport{base: base, slots: make(chan struct{}, limit)}
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case t.slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	release := func() { <-t.slots }
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody frees its request's slot the first time it is closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// inFlightCounter records the most requests its servers handled at the same time
+type inFlightCounter struct {
+	current, max int32
+}
+
+func (c *inFlightCounter) handler(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&c.current, 1)
+	defer atomic.AddInt32(&c.current, -1)
+	for {
+		seen := atomic.LoadInt32(&c.max)
+		if n <= seen || atomic.CompareAndSwapInt32(&c.max, seen, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	w.Write([]byte("ok"))
+}
+
+func TestLimitedTransport(t *testing.T) {
+	const limit, requests = 3, 24
+	counter := &inFlightCounter{}
+	// Stand-ins for Gemini and GitHub, both reached through the one limited client
+	gemini := httptest.NewServer(http.HandlerFunc(counter.handler))
+	defer gemini.Close()
+	github := httptest.NewServer(http.HandlerFunc(counter.handler))
+	defer github.Close()
+
+	client := &http.Client{Transport: newLimitedTransport(http.DefaultTransport.(*http.Transport).Clone(), limit)}
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		url := gemini.URL
+		if i%2 == 1 {
+			url = github.URL
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Errorf("Get: %v", err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if counter.max > limit {
+		t.Errorf("%d requests were in flight at once, want at most %d", counter.max, limit)
+	}
+	if counter.max < 2 {
+		t.Errorf("at most %d request was in flight, want them to run concurrently", counter.max)
+	}
+}
+
+func TestLimitedTransportWaitCancelled(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	client := &http.Client{Transport: newLimitedTransport(http.DefaultTransport.(*http.Transport).Clone(), 1)}
+	started := make(chan struct{})
+	go func() {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		close(started)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	time.Sleep(20 * time.Millisecond)
+
+	// The only slot is taken, a request giving up while waiting for it fails with its context error
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the deadline exceeded", err)
+	}
+}
+
+func TestNewLimitedTransportUnlimited(t *testing.T) {
+	base := http.DefaultTransport
+	if got := newLimitedTransport(base, 0); got != base {
+		t.Errorf("newLimitedTransport(base, 0) = %v, want base unchanged", got)
+	}
+}
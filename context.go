@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Limits on the read-only context files sent with every prompt
+const (
+	maxContextFiles     = 20
+	maxContextFileChars = 100000 // total for all context files
+)
+
+// ContextFile is an unchanged file of the repository shown to Gemini as read-only context
+type ContextFile struct {
+	Path    string
+	Content string
+}
+
+// listTreePaths returns the paths of every file of the repository at ref
+func (c *GitHubClient) listTreePaths(ctx context.Context, owner, repo, ref string) ([]string, error) {
+	treeURL := fmt.Sprintf("%s/repos/%s/%s/git/trees/%s?recursive=1", c.BaseURL, owner, repo, url.PathEscape(ref))
+	var tree struct {
+		Tree []struct {
+			Path string `json:"path"`
+			Type string `json:"type"`
+		} `json:"tree"`
+		Truncated bool `json:"truncated"`
+	}
+	if err := c.doJSON(ctx, "GET", treeURL, nil, http.StatusOK, &tree); err != nil {
+		return nil, fmt.Errorf("failed to list repository files: %v", err)
+	}
+	if tree.Truncated {
+		fmt.Println("Warning: the repository tree is too large to list completely, some context files may be missed")
+	}
+	var paths []string
+	for _, entry := range tree.Tree {
+		if entry.Type == "blob" {
+			paths = append(paths, entry.Path)
+		}
+	}
+	return paths, nil
+}
+
+// loadContextFiles fetches the files of the repository at ref matching one of the patterns,
+// up to maxContextFiles files and maxContextFileChars characters
+func (c *GitHubClient) loadContextFiles(ctx context.Context, owner, repo, ref string, patterns []string) ([]ContextFile, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	paths, err := c.listTreePaths(ctx, owner, repo, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []ContextFile
+	total := 0
+	for _, path := range paths {
+		if !matchesAnyPath(patterns, path) {
+			continue
+		}
+		if len(files) == maxContextFiles {
+			fmt.Printf("Warning: only the first %d context files are included\n", maxContextFiles)
+			break
+		}
+		content, err := c.getFileContent(ctx, owner, repo, path, ref)
+		if err != nil {
+			return nil, err
+		}
+		if total+len(content) > maxContextFileChars {
+			fmt.Printf("Warning: skipping context file %s, the context files would exceed %d characters\n", path, maxContextFileChars)
+			continue
+		}
+		total += len(content)
+		files = append(files, ContextFile{Path: path, Content: string(content)})
+	}
+	return files, nil
+}
+
+// formatContextFiles renders the context files for the system instruction, each in a code block
+// fenced longer than any backtick run it contains
+func formatContextFiles(files []ContextFile) string {
+	if len(files) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString(`
+Unchanged files of the repository, for reference only. Use them to understand the code being reviewed,
+but never comment on them or report issues in them:
+`)
+	for _, file := range files {
+		fence := "```"
+		for strings.Contains(file.Content, fence) {
+			fence += "`"
+		}
+		fmt.Fprintf(&sb, "\nFile: %s\n%s\n%s\n%s\n", file.Path, fence, strings.TrimSuffix(file.Content, "\n"), fence)
+	}
+	return sb.String()
+}
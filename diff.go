@@ -0,0 +1,508 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Side of the diff a comment targets, as used by the review API
+const (
+	SideLeft  = "LEFT"  // old file, for removed lines
+	SideRight = "RIGHT" // new file, for added and context lines
+)
+
+var hunkHeaderRegex = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+type Hunk struct {
+	Header  string
+	Content string
+	Lines   []string
+	// Position of the hunk header within the file's diff. The review API counts
+	// positions from the first "@@" header of a file, and later headers count too.
+	Position int
+	// Old and new file line numbers of each entry in Lines, 0 when the line
+	// does not exist on that side (added lines have no old number and vice versa)
+	OldLineNumbers []int
+	NewLineNumbers []int
+}
+
+type ParsedFile struct {
+	Path    string
+	Hunks   []Hunk
+	Deleted bool // the file is removed by the PR ("+++ /dev/null")
+	Added   bool // the file is created by the PR ("--- /dev/null")
+	Binary  bool // git reported "Binary files ... differ" instead of hunks
+}
+
+// AnnotatedContent returns the hunk lines prefixed with their new-file line number, as in
+// "42: +foo()", so Gemini can cite exact lines. Removed lines have no new number and a blank prefix.
+func (h Hunk) AnnotatedContent() string {
+	if len(h.Lines) == 0 {
+		return h.Content
+	}
+	width := 1
+	for _, n := range h.NewLineNumbers {
+		width = max(width, len(strconv.Itoa(n)))
+	}
+	var sb strings.Builder
+	for i, line := range h.Lines {
+		if n := h.NewLineNumbers[i]; n > 0 {
+			fmt.Fprintf(&sb, "%*d: %s\n", width, n, line)
+		} else {
+			fmt.Fprintf(&sb, "%*s: %s\n", width, "", line)
+		}
+	}
+	return sb.String()
+}
+
+// LastChangedLine returns where a comment on the hunk should be anchored: the last added
+// line on the RIGHT side or, for hunks that only remove code, the last removed line on the LEFT side
+func (h Hunk) LastChangedLine() (int, string) {
+	lastRemoved := 0
+	for i := len(h.Lines) - 1; i >= 0; i-- {
+		switch {
+		case strings.HasPrefix(h.Lines[i], "+"):
+			return h.NewLineNumbers[i], SideRight
+		case strings.HasPrefix(h.Lines[i], "-") && lastRemoved == 0:
+			lastRemoved = h.OldLineNumbers[i]
+		}
+	}
+	if lastRemoved > 0 {
+		return lastRemoved, SideLeft
+	}
+	// No changes at all, fall back to the last context line
+	if len(h.Lines) > 0 {
+		return h.NewLineNumbers[len(h.Lines)-1], SideRight
+	}
+	return 0, SideRight
+}
+
+// hunkRange is the old and new line range announced by a "@@ -a,b +c,d @@" header
+type hunkRange struct {
+	OldStart, OldCount int
+	NewStart, NewCount int
+}
+
+// ContainsNewLines reports whether every new-file line from start to end is part of the hunk,
+// which is required for a (multi-line) comment or suggestion on the RIGHT side
+func (h Hunk) ContainsNewLines(start, end int) bool {
+	for line := start; line <= end; line++ {
+		found := false
+		for _, n := range h.NewLineNumbers {
+			if n == line {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// IsAddedLine reports whether the new-file line n is added by the hunk
+func (h Hunk) IsAddedLine(n int) bool {
+	for i, line := range h.Lines {
+		if h.NewLineNumbers[i] == n && strings.HasPrefix(line, "+") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRemovedLine reports whether the old-file line n is removed by the hunk
+func (h Hunk) IsRemovedLine(n int) bool {
+	for i, line := range h.Lines {
+		if h.OldLineNumbers[i] == n && strings.HasPrefix(line, "-") {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidComment reports whether a comment targets a changed line of the diff: an added line on
+// the RIGHT side or a removed line on the LEFT side. Context lines can't be commented on reliably.
+// A multi-line comment must start in the same hunk. GitHub rejects the whole review otherwise.
+func ValidComment(comment Comment, files []ParsedFile) bool {
+	for _, file := range files {
+		if file.Path != comment.Path {
+			continue
+		}
+		for _, hunk := range file.Hunks {
+			if comment.Side == SideLeft && hunk.IsRemovedLine(comment.Line) {
+				return true
+			}
+			if comment.Side != SideLeft && hunk.IsAddedLine(comment.Line) {
+				return comment.StartLine == 0 || hunk.ContainsNewLines(comment.StartLine, comment.Line)
+			}
+		}
+	}
+	return false
+}
+
+// filterValidComments drops, with a warning, the comments ValidComment rejects
+func filterValidComments(comments []Comment, files []ParsedFile) []Comment {
+	var valid []Comment
+	for _, comment := range comments {
+		if !ValidComment(comment, files) {
+			fmt.Printf("Warning: dropping comment on %s line %d (%s), it doesn't target a changed line\n", comment.Path, comment.Line, comment.Side)
+			continue
+		}
+		valid = append(valid, comment)
+	}
+	return valid
+}
+
+// parseHunkHeader parses the ranges of a hunk header. Omitted counts default to 1.
+func parseHunkHeader(header string) (hunkRange, bool) {
+	matches := hunkHeaderRegex.FindStringSubmatch(header)
+	if matches == nil {
+		return hunkRange{}, false
+	}
+	atoi := func(s string, def int) int {
+		if s == "" {
+			return def
+		}
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	return hunkRange{
+		OldStart: atoi(matches[1], 0),
+		OldCount: atoi(matches[2], 1),
+		NewStart: atoi(matches[3], 0),
+		NewCount: atoi(matches[4], 1),
+	}, true
+}
+
+// DiffParseError reports the line of the diff that could not be parsed
+type DiffParseError struct {
+	Line    int // 1-based line number in the diff
+	Content string
+	Reason  string
+}
+
+func (e *DiffParseError) Error() string {
+	return fmt.Sprintf("malformed diff at line %d: %s: %q", e.Line, e.Reason, e.Content)
+}
+
+// isContentLine reports whether line looks like a hunk line (added, removed or context)
+func isContentLine(line string) bool {
+	return strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") || strings.HasPrefix(line, " ")
+}
+
+// parseDiff parses a unified diff into files and hunks. Lines are split on "\n" only, so
+// multi-byte UTF-8 content doesn't affect line numbers or positions; CRLF line endings, from
+// diffs saved on Windows or files with CRLF endings, are normalized to LF first.
+func parseDiff(diff string) ([]ParsedFile, error) {
+	diff = strings.ReplaceAll(diff, "\r\n", "\n")
+	var files []ParsedFile
+	var currentFile *ParsedFile
+	var currentHunk *Hunk
+	currentHunkLine := 0 // line number of the current hunk header, for errors
+	position := 0
+	oldLine, newLine := 0, 0
+	// Lines still expected in the current hunk according to its header
+	remainingOld, remainingNew := 0, 0
+
+	flushHunk := func() error {
+		if currentHunk == nil {
+			return nil
+		}
+		if remainingOld > 0 || remainingNew > 0 {
+			return &DiffParseError{
+				Line:    currentHunkLine,
+				Content: currentHunk.Header,
+				Reason:  fmt.Sprintf("hunk is truncated, %d old and %d new line(s) missing", remainingOld, remainingNew),
+			}
+		}
+		currentFile.Hunks = append(currentFile.Hunks, *currentHunk)
+		currentHunk = nil
+		return nil
+	}
+
+	appendLine := func(line string, oldNumber, newNumber int) {
+		position++
+		currentHunk.Lines = append(currentHunk.Lines, line)
+		currentHunk.Content += line + "\n"
+		currentHunk.OldLineNumbers = append(currentHunk.OldLineNumbers, oldNumber)
+		currentHunk.NewLineNumbers = append(currentHunk.NewLineNumbers, newNumber)
+	}
+
+	lines := strings.Split(diff, "\n")
+	for i, line := range lines {
+		lineNumber := i + 1
+		endOfDiff := i == len(lines)-1 && line == ""
+		inHunk := currentHunk != nil && (remainingOld > 0 || remainingNew > 0) && !endOfDiff &&
+			!strings.HasPrefix(line, "@@") && !strings.HasPrefix(line, "diff --git")
+
+		switch {
+		case inHunk && !strings.HasPrefix(line, "\\"):
+			switch {
+			case strings.HasPrefix(line, "+"):
+				appendLine(line, 0, newLine)
+				newLine++
+				remainingNew--
+			case strings.HasPrefix(line, "-"):
+				appendLine(line, oldLine, 0)
+				oldLine++
+				remainingOld--
+			case strings.HasPrefix(line, " ") || line == "":
+				// Some tools strip the leading space of empty context lines
+				appendLine(line, oldLine, newLine)
+				oldLine++
+				newLine++
+				remainingOld--
+				remainingNew--
+			default:
+				return nil, &DiffParseError{Line: lineNumber, Content: line, Reason: "unexpected line inside a hunk"}
+			}
+			if remainingOld < 0 || remainingNew < 0 {
+				return nil, &DiffParseError{Line: lineNumber, Content: line, Reason: "hunk has more lines than its header announces"}
+			}
+
+		case strings.HasPrefix(line, "\\"):
+			// "\ No newline at end of file" describes the line before it. It isn't content,
+			// so it is left out of the hunk and doesn't take up a position.
+			if currentHunk == nil {
+				return nil, &DiffParseError{Line: lineNumber, Content: line, Reason: "marker line outside of a hunk"}
+			}
+
+		case strings.HasPrefix(line, "diff --git"):
+			if err := flushHunk(); err != nil {
+				return nil, err
+			}
+			if currentFile != nil {
+				files = append(files, *currentFile)
+			}
+			currentFile = &ParsedFile{}
+			position = 0
+
+		case strings.HasPrefix(line, "@@"):
+			if currentFile == nil {
+				return nil, &DiffParseError{Line: lineNumber, Content: line, Reason: "hunk header before any file header"}
+			}
+			hunkRange, ok := parseHunkHeader(line)
+			if !ok {
+				return nil, &DiffParseError{Line: lineNumber, Content: line, Reason: "malformed hunk header"}
+			}
+			// The first header of a file is position 0, later headers take up a position
+			if currentHunk != nil || len(currentFile.Hunks) > 0 {
+				position++
+			}
+			if err := flushHunk(); err != nil {
+				return nil, err
+			}
+			currentHunk = &Hunk{Header: line, Position: position}
+			currentHunkLine = lineNumber
+			oldLine, newLine = hunkRange.OldStart, hunkRange.NewStart
+			remainingOld, remainingNew = hunkRange.OldCount, hunkRange.NewCount
+
+		case line == "":
+			// The trailing newline of the diff produces an empty line
+
+		case currentFile == nil:
+			if isContentLine(line) {
+				return nil, &DiffParseError{Line: lineNumber, Content: line, Reason: "hunk line before any file header"}
+			}
+
+		case currentHunk == nil && strings.HasPrefix(line, "--- a/"):
+			currentFile.Path = strings.TrimPrefix(line, "--- a/")
+
+		case currentHunk == nil && strings.HasPrefix(line, "+++ b/"):
+			currentFile.Path = strings.TrimPrefix(line, "+++ b/")
+
+		case currentHunk == nil && line == "+++ /dev/null":
+			currentFile.Deleted = true
+
+		case currentHunk == nil && line == "--- /dev/null":
+			// New file, the path comes from the "+++" line
+			currentFile.Added = true
+
+		case currentHunk == nil && strings.HasPrefix(line, "Binary files "):
+			currentFile.Binary = true
+			if currentFile.Path == "" {
+				currentFile.Path = binaryFilePath(line)
+			}
+
+		case isContentLine(line):
+			// Extended headers (index, mode, rename...) never start like hunk lines
+			return nil, &DiffParseError{Line: lineNumber, Content: line, Reason: "line outside of any hunk"}
+		}
+	}
+	if err := flushHunk(); err != nil {
+		return nil, err
+	}
+	if currentFile != nil {
+		files = append(files, *currentFile)
+	}
+	return files, nil
+}
+
+// binaryFilePath extracts the new path from a "Binary files a/x and b/x differ" line
+func binaryFilePath(line string) string {
+	line = strings.TrimSuffix(strings.TrimPrefix(line, "Binary files "), " differ")
+	if i := strings.LastIndex(line, " and "); i >= 0 {
+		line = line[i+len(" and "):]
+	}
+	return strings.TrimPrefix(line, "b/")
+}
+
+// parseFilePatch parses the hunks of a single file patch, as the pull request files API returns
+// it: hunks without the file headers. Positions count from the first hunk header, as in parseDiff.
+func parseFilePatch(patch string) ([]Hunk, error) {
+	if strings.TrimSpace(patch) == "" {
+		return nil, nil
+	}
+	files, err := parseDiff("diff --git a/file b/file\n--- a/file\n+++ b/file\n" + patch)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	return files[0].Hunks, nil
+}
+
+// diffSize returns the size in bytes of the hunks of files, close to the size of the unified diff
+func diffSize(files []ParsedFile) int {
+	size := 0
+	for _, file := range files {
+		for _, hunk := range file.Hunks {
+			size += len(hunk.Header) + 1 + len(hunk.Content)
+		}
+	}
+	return size
+}
+
+// filterReviewableFiles drops files that have nothing for Gemini to review:
+// deleted files, binary files and files without any hunks
+func filterReviewableFiles(files []ParsedFile) []ParsedFile {
+	var reviewable []ParsedFile
+	for _, file := range files {
+		if file.Deleted || file.Binary || len(file.Hunks) == 0 {
+			continue
+		}
+		reviewable = append(reviewable, file)
+	}
+	return reviewable
+}
+
+// filterOnlyFile keeps the file with the given path, if it changed
+func filterOnlyFile(files []ParsedFile, path string) []ParsedFile {
+	path = strings.TrimPrefix(strings.TrimSpace(path), "/")
+	for _, file := range files {
+		if file.Path == path {
+			return []ParsedFile{file}
+		}
+	}
+	return nil
+}
+
+// filterNewFiles keeps only the files created by the PR
+func filterNewFiles(files []ParsedFile) []ParsedFile {
+	var added []ParsedFile
+	for _, file := range files {
+		if file.Added {
+			added = append(added, file)
+		}
+	}
+	return added
+}
+
+// IsWhitespaceOnly reports whether the hunk only changes whitespace: its removed and added lines
+// are the same once whitespace is stripped, ignoring lines that are blank
+func (h Hunk) IsWhitespaceOnly() bool {
+	var removed, added []string
+	for _, line := range h.Lines {
+		if len(line) == 0 || (line[0] != '-' && line[0] != '+') {
+			continue
+		}
+		stripped := strings.Join(strings.Fields(line[1:]), "")
+		switch {
+		case stripped == "":
+		case line[0] == '-':
+			removed = append(removed, stripped)
+		default:
+			added = append(added, stripped)
+		}
+	}
+	if len(removed) != len(added) {
+		return false
+	}
+	for i := range removed {
+		if removed[i] != added[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// filterWhitespaceOnlyHunks drops the hunks that only change whitespace, and the files left
+// without hunks, returning how many hunks were dropped
+func filterWhitespaceOnlyHunks(files []ParsedFile) ([]ParsedFile, int) {
+	var kept []ParsedFile
+	dropped := 0
+	for _, file := range files {
+		var hunks []Hunk
+		for _, hunk := range file.Hunks {
+			if hunk.IsWhitespaceOnly() {
+				dropped++
+				continue
+			}
+			hunks = append(hunks, hunk)
+		}
+		if len(hunks) > 0 {
+			file.Hunks = hunks
+			kept = append(kept, file)
+		}
+	}
+	return kept, dropped
+}
+
+// splitHunk splits a hunk with more than maxLines lines into sequential chunks so each fits in a
+// single Gemini request. Every chunk keeps its own positions and line numbers, so comments on a
+// chunk anchor to the same place they would on the original hunk.
+func splitHunk(hunk Hunk, maxLines int) []Hunk {
+	if maxLines <= 0 || len(hunk.Lines) <= maxLines {
+		return []Hunk{hunk}
+	}
+
+	total := (len(hunk.Lines) + maxLines - 1) / maxLines
+	var chunks []Hunk
+	for start := 0; start < len(hunk.Lines); start += maxLines {
+		end := start + maxLines
+		if end > len(hunk.Lines) {
+			end = len(hunk.Lines)
+		}
+		lines := hunk.Lines[start:end]
+		chunks = append(chunks, Hunk{
+			Header:         fmt.Sprintf("%s (part %d/%d)", hunk.Header, len(chunks)+1, total),
+			Content:        strings.Join(lines, "\n") + "\n",
+			Lines:          lines,
+			Position:       hunk.Position + start,
+			OldLineNumbers: hunk.OldLineNumbers[start:end],
+			NewLineNumbers: hunk.NewLineNumbers[start:end],
+		})
+	}
+	return chunks
+}
+
+// chunkLargeHunks applies splitHunk to every hunk of every file
+func chunkLargeHunks(files []ParsedFile, maxLines int) []ParsedFile {
+	if maxLines <= 0 {
+		return files
+	}
+	chunked := make([]ParsedFile, 0, len(files))
+	for _, file := range files {
+		var hunks []Hunk
+		for _, hunk := range file.Hunks {
+			hunks = append(hunks, splitHunk(hunk, maxLines)...)
+		}
+		file.Hunks = hunks
+		chunked = append(chunked, file)
+	}
+	return chunked
+}
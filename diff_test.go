@@ -0,0 +1,345 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sampleDiff = `diff --git a/main.go b/main.go
+index 1111111..2222222 100644
+--- a/main.go
++++ b/main.go
+@@ -8,3 +8,4 @@ func main() {
+ 	ctx := context.Background()
+-	run(ctx)
++	if err := run(ctx); err != nil {
++		log.Fatal(err)
+ 	}
+@@ -20,2 +20,3 @@ func run() {
+ 	a()
++	b()
+ 	c()
+diff --git a/new.go b/new.go
+new file mode 100644
+--- /dev/null
++++ b/new.go
+@@ -0,0 +1,2 @@
++package main
++
+`
+
+func TestParseDiff(t *testing.T) {
+	files, err := parseDiff(sampleDiff)
+	if err != nil {
+		t.Fatalf("parseDiff: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got %d files, want 2", len(files))
+	}
+
+	tests := []struct {
+		name      string
+		hunk      Hunk
+		newNumber []int
+		oldNumber []int
+	}{
+		{"modified", files[0].Hunks[0], []int{8, 0, 9, 10, 11}, []int{8, 9, 0, 0, 10}},
+		{"second hunk", files[0].Hunks[1], []int{20, 21, 22}, []int{20, 0, 21}},
+		{"added file", files[1].Hunks[0], []int{1, 2}, []int{0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.hunk.NewLineNumbers, tt.newNumber) {
+				t.Errorf("NewLineNumbers = %v, want %v", tt.hunk.NewLineNumbers, tt.newNumber)
+			}
+			if !reflect.DeepEqual(tt.hunk.OldLineNumbers, tt.oldNumber) {
+				t.Errorf("OldLineNumbers = %v, want %v", tt.hunk.OldLineNumbers, tt.oldNumber)
+			}
+		})
+	}
+	if files[0].Added || !files[1].Added {
+		t.Errorf("Added = %v, %v, want false, true", files[0].Added, files[1].Added)
+	}
+}
+
+func TestParseDiffNoNewlineMarker(t *testing.T) {
+	const diff = `diff --git a/a.txt b/a.txt
+--- a/a.txt
++++ b/a.txt
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++b
+\ No newline at end of file
+`
+	files, err := parseDiff(diff)
+	if err != nil {
+		t.Fatalf("parseDiff: %v", err)
+	}
+	hunk := files[0].Hunks[0]
+	if want := []string{" a", "-b", "+b"}; !reflect.DeepEqual(hunk.Lines, want) {
+		t.Errorf("Lines = %q, want %q", hunk.Lines, want)
+	}
+	if want := []int{1, 0, 2}; !reflect.DeepEqual(hunk.NewLineNumbers, want) {
+		t.Errorf("NewLineNumbers = %v, want %v", hunk.NewLineNumbers, want)
+	}
+	if want := []int{1, 2, 0}; !reflect.DeepEqual(hunk.OldLineNumbers, want) {
+		t.Errorf("OldLineNumbers = %v, want %v", hunk.OldLineNumbers, want)
+	}
+}
+
+func TestParseDiffLineEndings(t *testing.T) {
+	tests := []struct {
+		name string
+		diff string
+		want []string
+	}{
+		{
+			name: "crlf",
+			diff: "diff --git a/a.txt b/a.txt\r\n--- a/a.txt\r\n+++ b/a.txt\r\n@@ -1,2 +1,2 @@\r\n ctx\r\n-old\r\n+new\r\n",
+			want: []string{" ctx", "-old", "+new"},
+		},
+		{
+			name: "non-ascii",
+			diff: "diff --git a/ü.go b/ü.go\n--- a/ü.go\n+++ b/ü.go\n@@ -1,2 +1,3 @@\n var größe = 1\n-var 名前 = \"a\"\n+var 名前 = \"日本\"\n+var ñ = \"🎉\"\n",
+			want: []string{" var größe = 1", "-var 名前 = \"a\"", "+var 名前 = \"日本\"", "+var ñ = \"🎉\""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := parseDiff(tt.diff)
+			if err != nil {
+				t.Fatalf("parseDiff: %v", err)
+			}
+			hunk := files[0].Hunks[0]
+			if !reflect.DeepEqual(hunk.Lines, tt.want) {
+				t.Errorf("Lines = %q, want %q", hunk.Lines, tt.want)
+			}
+			// The last line of the hunk is on the line its header announces
+			if last := hunk.NewLineNumbers[len(hunk.NewLineNumbers)-1]; last != len(tt.want)-1 {
+				t.Errorf("last new line = %d, want %d", last, len(tt.want)-1)
+			}
+		})
+	}
+}
+
+func TestLastChangedLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		diff     string
+		wantLine int
+		wantSide string
+	}{
+		{
+			name:     "added lines",
+			diff:     "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n@@ -1,2 +1,3 @@\n a\n+b\n c\n",
+			wantLine: 2,
+			wantSide: SideRight,
+		},
+		{
+			name:     "deletion only",
+			diff:     "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n@@ -4,4 +4,2 @@\n a\n-b\n-c\n d\n",
+			wantLine: 6,
+			wantSide: SideLeft,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := parseDiff(tt.diff)
+			if err != nil {
+				t.Fatalf("parseDiff: %v", err)
+			}
+			hunk := files[0].Hunks[0]
+			if line, side := hunk.LastChangedLine(); line != tt.wantLine || side != tt.wantSide {
+				t.Errorf("LastChangedLine() = %d %s, want %d %s", line, side, tt.wantLine, tt.wantSide)
+			}
+			// A finding Gemini can't anchor on an added line lands on the last change
+			comment := findingComment("a.go", hunk, Finding{Severity: SeverityInfo, Comment: "x", Line: 99})
+			if comment.Line != tt.wantLine || comment.Side != tt.wantSide {
+				t.Errorf("comment on %d %s, want %d %s", comment.Line, comment.Side, tt.wantLine, tt.wantSide)
+			}
+		})
+	}
+}
+
+func TestIsWhitespaceOnly(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  bool
+	}{
+		{"reindented", []string{"-  x := 1", "+\tx := 1"}, true},
+		{"blank line added", []string{" a", "+", " b"}, true},
+		{"code changed", []string{"-x := 1", "+x := 2"}, false},
+		{"line added", []string{"+x := 1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (Hunk{Lines: tt.lines}).IsWhitespaceOnly(); got != tt.want {
+				t.Errorf("IsWhitespaceOnly() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterWhitespaceOnlyHunks(t *testing.T) {
+	files := []ParsedFile{
+		{Path: "a.go", Hunks: []Hunk{{Lines: []string{"-  x", "+\tx"}}, {Lines: []string{"-x", "+y"}}}},
+		{Path: "b.go", Hunks: []Hunk{{Lines: []string{"-  y", "+ y"}}}},
+	}
+	kept, dropped := filterWhitespaceOnlyHunks(files)
+	if dropped != 2 {
+		t.Errorf("dropped = %d, want 2", dropped)
+	}
+	if len(kept) != 1 || kept[0].Path != "a.go" || len(kept[0].Hunks) != 1 {
+		t.Errorf("kept = %+v, want a.go with one hunk", kept)
+	}
+}
+
+func TestSplitHunk(t *testing.T) {
+	files, err := parseDiff(sampleDiff)
+	if err != nil {
+		t.Fatalf("parseDiff: %v", err)
+	}
+	hunk := files[0].Hunks[0]
+	tests := []struct {
+		name      string
+		maxLines  int
+		wantLines [][]int // new line numbers of each chunk
+	}{
+		{"no limit", 0, [][]int{{8, 0, 9, 10, 11}}},
+		{"fits", 5, [][]int{{8, 0, 9, 10, 11}}},
+		{"split", 2, [][]int{{8, 0}, {9, 10}, {11}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := splitHunk(hunk, tt.maxLines)
+			var got [][]int
+			for _, chunk := range chunks {
+				got = append(got, chunk.NewLineNumbers)
+				if len(chunk.Lines) != len(chunk.OldLineNumbers) {
+					t.Errorf("chunk %q has %d lines and %d old numbers", chunk.Header, len(chunk.Lines), len(chunk.OldLineNumbers))
+				}
+			}
+			if !reflect.DeepEqual(got, tt.wantLines) {
+				t.Errorf("chunks = %v, want %v", got, tt.wantLines)
+			}
+		})
+	}
+
+	// Findings on a chunk anchor where they would on the whole hunk
+	chunks := splitHunk(hunk, 2)
+	comment := findingComment("main.go", chunks[1], Finding{Severity: SeverityInfo, Comment: "x", Line: 10})
+	if comment.Line != 10 || comment.Side != SideRight {
+		t.Errorf("comment on %d %s, want 10 RIGHT", comment.Line, comment.Side)
+	}
+	if want := "@@ -8,3 +8,4 @@ func main() { (part 2/3)"; chunks[1].Header != want {
+		t.Errorf("Header = %q, want %q", chunks[1].Header, want)
+	}
+}
+
+func TestChunkLargeHunks(t *testing.T) {
+	files, err := parseDiff(sampleDiff)
+	if err != nil {
+		t.Fatalf("parseDiff: %v", err)
+	}
+	chunked := chunkLargeHunks(files, 3)
+	if got := []int{len(chunked[0].Hunks), len(chunked[1].Hunks)}; !reflect.DeepEqual(got, []int{3, 1}) {
+		t.Errorf("hunks per file = %v, want [3 1]", got)
+	}
+}
+
+func TestParseDiffMalformed(t *testing.T) {
+	const header = "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n"
+	tests := []struct {
+		name     string
+		diff     string
+		wantLine int
+		wantText string
+	}{
+		{"truncated hunk", header + "@@ -1,3 +1,3 @@\n a\n", 4, "hunk is truncated"},
+		{"more lines than announced", header + "@@ -1 +1 @@\n-a\n+b\n+c\n", 7, "line outside of any hunk"},
+		{"malformed header", header + "@@ -x +1 @@\n", 4, "malformed hunk header"},
+		{"hunk before any file", "@@ -1 +1 @@\n-a\n+b\n", 1, "hunk header before any file header"},
+		{"unexpected line", header + "@@ -1,2 +1,2 @@\n a\n?b\n", 6, "unexpected line inside a hunk"},
+		{"marker outside of a hunk", header + "\\ No newline at end of file\n", 4, "marker line outside of a hunk"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDiff(tt.diff)
+			var parseErr *DiffParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("err = %v, want a DiffParseError", err)
+			}
+			if parseErr.Line != tt.wantLine || !strings.Contains(parseErr.Reason, tt.wantText) {
+				t.Errorf("err = %v, want line %d and %q", err, tt.wantLine, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestAnnotatedContent(t *testing.T) {
+	files, err := parseDiff(sampleDiff)
+	if err != nil {
+		t.Fatalf("parseDiff: %v", err)
+	}
+	want := " 8:  \tctx := context.Background()\n" +
+		"  : -\trun(ctx)\n" +
+		" 9: +\tif err := run(ctx); err != nil {\n" +
+		"10: +\t\tlog.Fatal(err)\n" +
+		"11:  \t}\n"
+	if got := files[0].Hunks[0].AnnotatedContent(); got != want {
+		t.Errorf("AnnotatedContent() =\n%s\nwant\n%s", got, want)
+	}
+
+	// A line cited from the annotation anchors the comment on that line
+	comment := findingComment("main.go", files[0].Hunks[0], Finding{Severity: SeverityWarning, Comment: "x", Line: 10})
+	if comment.Line != 10 || comment.Side != SideRight {
+		t.Errorf("comment on %d %s, want 10 RIGHT", comment.Line, comment.Side)
+	}
+}
+
+func TestValidComment(t *testing.T) {
+	files, err := parseDiff(sampleDiff)
+	if err != nil {
+		t.Fatalf("parseDiff: %v", err)
+	}
+	tests := []struct {
+		name    string
+		comment Comment
+		want    bool
+	}{
+		{"added line", Comment{Path: "main.go", Line: 9, Side: SideRight}, true},
+		{"removed line", Comment{Path: "main.go", Line: 9, Side: SideLeft}, true},
+		{"context line", Comment{Path: "main.go", Line: 8, Side: SideRight}, false},
+		{"multi-line in hunk", Comment{Path: "main.go", StartLine: 9, Line: 10, Side: SideRight}, true},
+		{"multi-line across hunks", Comment{Path: "main.go", StartLine: 10, Line: 21, Side: SideRight}, false},
+		{"other file", Comment{Path: "other.go", Line: 9, Side: SideRight}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidComment(tt.comment, files); got != tt.want {
+				t.Errorf("ValidComment() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterValidComments(t *testing.T) {
+	files, err := parseDiff(sampleDiff)
+	if err != nil {
+		t.Fatalf("parseDiff: %v", err)
+	}
+	comments := []Comment{
+		{Path: "main.go", Line: 9, Side: SideRight, Body: "kept"},
+		{Path: "main.go", Line: 400, Side: SideRight, Body: "out of range"},
+		{Path: "new.go", Line: 2, Side: SideRight, Body: "kept too"},
+	}
+	kept := filterValidComments(comments, files)
+	if len(kept) != 2 || kept[0].Body != "kept" || kept[1].Body != "kept too" {
+		t.Errorf("kept %+v, want the two comments on changed lines", kept)
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Severities Gemini can assign to a finding, from most to least important
+const (
+	SeverityCritical = "critical"
+	SeverityWarning  = "warning"
+	SeverityInfo     = "info"
+)
+
+// Finding is a single issue Gemini reports for a hunk. Line and StartLine are new-file
+// line numbers; Suggestion optionally replaces lines StartLine..Line.
+type Finding struct {
+	Severity   string `json:"severity"`
+	Comment    string `json:"comment"`
+	Line       int    `json:"line,omitempty"`
+	StartLine  int    `json:"start_line,omitempty"`
+	Suggestion string `json:"suggestion,omitempty"`
+	Rationale  string `json:"rationale,omitempty"`
+}
+
+// findingsSchema constrains Gemini's JSON output to a list of findings
+var findingsSchema = &geminiSchema{
+	Type: "ARRAY",
+	Items: &geminiSchema{
+		Type: "OBJECT",
+		Properties: map[string]*geminiSchema{
+			"severity":   {Type: "STRING", Enum: []string{SeverityCritical, SeverityWarning, SeverityInfo}},
+			"comment":    {Type: "STRING"},
+			"line":       {Type: "INTEGER"},
+			"start_line": {Type: "INTEGER"},
+			"suggestion": {Type: "STRING"},
+		},
+		Required: []string{"severity", "comment"},
+	},
+}
+
+// rationaleFindingsSchema is findingsSchema with the rationale Gemini gives when asked to explain its findings
+var rationaleFindingsSchema = func() *geminiSchema {
+	properties := map[string]*geminiSchema{"rationale": {Type: "STRING"}}
+	for name, property := range findingsSchema.Items.Properties {
+		properties[name] = property
+	}
+	return &geminiSchema{
+		Type: "ARRAY",
+		Items: &geminiSchema{
+			Type:       "OBJECT",
+			Properties: properties,
+			Required:   []string{"severity", "comment", "rationale"},
+		},
+	}
+}()
+
+// normalizeSeverity maps a severity to one of the known values, defaulting to info
+func normalizeSeverity(severity string) string {
+	switch severity = strings.ToLower(strings.TrimSpace(severity)); severity {
+	case SeverityCritical, SeverityWarning:
+		return severity
+	default:
+		return SeverityInfo
+	}
+}
+
+// severityRank orders severities, higher is more important
+func severityRank(severity string) int {
+	switch severity {
+	case SeverityCritical:
+		return 2
+	case SeverityWarning:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// parseFindings decodes Gemini's JSON response. A response that isn't valid JSON is kept
+// as a single informational finding so the feedback isn't lost.
+func parseFindings(text string) []Finding {
+	var findings []Finding
+	if err := json.Unmarshal([]byte(extractJSON(text)), &findings); err != nil {
+		// A response cut short, e.g. by a dropped stream, still has its complete findings
+		if recovered := recoverFindings(text); len(recovered) > 0 {
+			fmt.Printf("Warning: Gemini response is truncated, keeping the %d complete finding(s): %v\n", len(recovered), err)
+			findings = recovered
+		} else {
+			fmt.Printf("Warning: Gemini response is not valid JSON, keeping it as a single comment: %v\n", err)
+			return []Finding{{Severity: SeverityInfo, Comment: text}}
+		}
+	}
+
+	var valid []Finding
+	for _, finding := range findings {
+		if strings.TrimSpace(finding.Comment) == "" {
+			continue
+		}
+		finding.Severity = normalizeSeverity(finding.Severity)
+		valid = append(valid, finding)
+	}
+	return valid
+}
+
+// recoverFindings decodes the complete objects of a possibly truncated JSON array of findings,
+// ignoring the partial object at the end
+func recoverFindings(text string) []Finding {
+	start := strings.Index(text, "[")
+	if start < 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(text[start:]))
+	if _, err := decoder.Token(); err != nil {
+		return nil
+	}
+	var findings []Finding
+	for decoder.More() {
+		var finding Finding
+		if err := decoder.Decode(&finding); err != nil {
+			break
+		}
+		findings = append(findings, finding)
+	}
+	return findings
+}
+
+// fencedBlockRegex matches the first markdown code block, with an optional language tag
+var fencedBlockRegex = regexp.MustCompile("(?s)```[a-zA-Z]*[ \t]*\n(.*?)\n?```")
+
+// extractJSON strips what Gemini sometimes wraps around its JSON when structured output isn't
+// honored: a markdown code fence and prose before or after the array.
+func extractJSON(text string) string {
+	text = strings.TrimSpace(text)
+	if json.Valid([]byte(text)) {
+		return text
+	}
+	if match := fencedBlockRegex.FindStringSubmatch(text); match != nil {
+		text = strings.TrimSpace(match[1])
+	}
+	start := strings.Index(text, "[")
+	end := strings.LastIndex(text, "]")
+	if start < 0 || end < start {
+		return text
+	}
+	return text[start : end+1]
+}
+
+// formatFindingBody renders a finding as a comment body with its severity label.
+// The suggestion is only rendered when withSuggestion is set, i.e. when it targets valid lines.
+func formatFindingBody(finding Finding, withSuggestion bool) string {
+	label := strings.ToUpper(finding.Severity[:1]) + finding.Severity[1:]
+	body := fmt.Sprintf("**%s:** %s", label, finding.Comment)
+	if rationale := strings.TrimSpace(finding.Rationale); rationale != "" {
+		body += "\n\n<details>\n<summary>Why?</summary>\n\n" + rationale + "\n\n</details>"
+	}
+	if withSuggestion && finding.Suggestion != "" {
+		body += "\n\n" + formatSuggestion(finding.Suggestion)
+	}
+	return body
+}
+
+// formatSuggestion wraps code in a GitHub suggestion block. The fence is made longer
+// than any backtick run in the code so the block can't be closed early.
+func formatSuggestion(code string) string {
+	fence := "```"
+	for strings.Contains(code, fence) {
+		fence += "`"
+	}
+	return fmt.Sprintf("%ssuggestion\n%s\n%s", fence, strings.TrimSuffix(code, "\n"), fence)
+}
+
+// findingComment anchors a finding in the hunk. A finding that ends on a line added by the hunk,
+// with all its lines inside the hunk, targets them, with a suggestion block when it has one.
+// Other findings are relocated to the hunk's last changed line and keep their suggestion out.
+func findingComment(path string, hunk Hunk, finding Finding) Comment {
+	startLine := finding.StartLine
+	if startLine == 0 {
+		startLine = finding.Line
+	}
+	if finding.Line > 0 && startLine <= finding.Line && hunk.IsAddedLine(finding.Line) && hunk.ContainsNewLines(startLine, finding.Line) {
+		comment := Comment{
+			Path:     path,
+			Line:     finding.Line,
+			Side:     SideRight,
+			Body:     formatFindingBody(finding, true),
+			Severity: finding.Severity,
+		}
+		if startLine < finding.Line {
+			comment.StartLine = startLine
+			comment.StartSide = SideRight
+		}
+		return comment
+	}
+
+	line, side := hunk.LastChangedLine()
+	return Comment{
+		Path:     path,
+		Line:     line,
+		Side:     side,
+		Body:     formatFindingBody(finding, false),
+		Severity: finding.Severity,
+	}
+}
+
+// limitCommentsPerFile keeps the maxPerFile most severe comments of each file and notes how many
+// were dropped in the file's last kept comment. The kept comments are in sortComments order, so the
+// note stays on the file's last comment once the review is sorted. 0 or less means unlimited.
+func limitCommentsPerFile(comments []Comment, maxPerFile int) []Comment {
+	if maxPerFile <= 0 {
+		return comments
+	}
+
+	var paths []string
+	byPath := map[string][]Comment{}
+	for _, comment := range comments {
+		if _, seen := byPath[comment.Path]; !seen {
+			paths = append(paths, comment.Path)
+		}
+		byPath[comment.Path] = append(byPath[comment.Path], comment)
+	}
+
+	var limited []Comment
+	for _, path := range paths {
+		fileComments := byPath[path]
+		sort.SliceStable(fileComments, func(i, j int) bool {
+			return severityRank(fileComments[i].Severity) > severityRank(fileComments[j].Severity)
+		})
+		if dropped := len(fileComments) - maxPerFile; dropped > 0 {
+			fileComments = fileComments[:maxPerFile]
+			sortComments(fileComments)
+			last := &fileComments[maxPerFile-1]
+			last.Body += fmt.Sprintf("\n\n_%d more lower-priority finding(s) on this file were omitted._", dropped)
+		}
+		limited = append(limited, fileComments...)
+	}
+	return limited
+}
+
+// formatLineRange renders the lines a comment covers, "12" or "10-12" for a multi-line comment
+func formatLineRange(comment Comment) string {
+	if comment.StartLine > 0 {
+		return fmt.Sprintf("%d-%d", comment.StartLine, comment.Line)
+	}
+	return fmt.Sprint(comment.Line)
+}
+
+// formatFindingsTable renders the review comments as a markdown table for the job summary
+func formatFindingsTable(comments []Comment) string {
+	var sb strings.Builder
+	sb.WriteString("### Gemini review findings\n\n")
+	if len(comments) == 0 {
+		sb.WriteString("Gemini found no issues.\n")
+		return sb.String()
+	}
+
+	sb.WriteString("| File | Line | Severity | Comment |\n")
+	sb.WriteString("| --- | ---: | --- | --- |\n")
+	for _, comment := range comments {
+		line := formatLineRange(comment)
+		severity := comment.Severity
+		if severity == "" {
+			severity = SeverityInfo
+		}
+		fmt.Fprintf(&sb, "| `%s` | %s | %s | %s |\n", comment.Path, line, severity, tableCell(commentSummary(comment.Body)))
+	}
+	return sb.String()
+}
+
+// commentSummary returns the text of a comment body without its severity label,
+// suggestion block or trailing notes
+func commentSummary(body string) string {
+	summary, _, _ := strings.Cut(body, "\n\n")
+	if strings.HasPrefix(summary, "**") {
+		if _, text, found := strings.Cut(summary[2:], ":** "); found {
+			summary = text
+		}
+	}
+	return summary
+}
+
+// tableCell escapes text so it stays inside a single markdown table cell
+func tableCell(text string) string {
+	text = strings.ReplaceAll(text, "|", "\\|")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\n", "<br>")
+}
+
+// sortComments orders comments by path, then line, then most severe first, so a review
+// comes out the same from one run to the next
+func sortComments(comments []Comment) {
+	sort.SliceStable(comments, func(i, j int) bool {
+		a, b := comments[i], comments[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return severityRank(a.Severity) > severityRank(b.Severity)
+	})
+}
+
+// splitInlineComments separates the comments at or above minSeverity, posted inline, from the
+// less severe ones rolled into the review body. An empty minSeverity keeps every comment inline.
+func splitInlineComments(comments []Comment, minSeverity string) (inline, summarized []Comment) {
+	if minSeverity == "" {
+		return comments, nil
+	}
+	for _, comment := range comments {
+		if severityRank(comment.Severity) >= severityRank(minSeverity) {
+			inline = append(inline, comment)
+		} else {
+			summarized = append(summarized, comment)
+		}
+	}
+	return inline, summarized
+}
+
+// formatSummarizedComments renders the comments kept out of the inline review as a collapsed
+// section of the review body
+func formatSummarizedComments(comments []Comment) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<details>\n<summary>%d lower-severity finding(s)</summary>\n\n", len(comments))
+	for _, comment := range comments {
+		line := formatLineRange(comment)
+		severity := comment.Severity
+		if severity == "" {
+			severity = SeverityInfo
+		}
+		fmt.Fprintf(&sb, "- `%s:%s` (%s) %s\n", comment.Path, line, severity, strings.ReplaceAll(commentSummary(comment.Body), "\n", " "))
+	}
+	sb.WriteString("\n</details>")
+	return sb.String()
+}
+
+// formatCommentsBySeverity renders the comments kept out of the inline review as one collapsed
+// section per severity, most severe first, with the number of findings in each header
+func formatCommentsBySeverity(comments []Comment) string {
+	groups := map[string][]Comment{}
+	for _, comment := range comments {
+		severity := normalizeSeverity(comment.Severity)
+		groups[severity] = append(groups[severity], comment)
+	}
+
+	var sections []string
+	for _, severity := range []string{SeverityCritical, SeverityWarning, SeverityInfo} {
+		group := groups[severity]
+		if len(group) == 0 {
+			continue
+		}
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "<details>\n<summary>%s (%d)</summary>\n\n", severityTitle(severity), len(group))
+		for _, comment := range group {
+			line := formatLineRange(comment)
+			fmt.Fprintf(&sb, "- `%s:%s` %s\n", comment.Path, line, strings.ReplaceAll(commentSummary(comment.Body), "\n", " "))
+		}
+		sb.WriteString("\n</details>")
+		sections = append(sections, sb.String())
+	}
+	return strings.Join(sections, "\n\n")
+}
+
+// severityTitle is the heading used for a severity in the review body
+func severityTitle(severity string) string {
+	switch severity {
+	case SeverityCritical:
+		return "Critical"
+	case SeverityWarning:
+		return "Warning"
+	default:
+		return "Info"
+	}
+}
+
+// formatUnpostedReview renders a review that couldn't be posted, with the full comment bodies,
+// so the findings can still be read from the job summary
+func formatUnpostedReview(body string, comments []Comment) string {
+	var sb strings.Builder
+	sb.WriteString("### Gemini review (not posted)\n\n")
+	sb.WriteString("Posting the review failed, these are the comments it contained.\n\n")
+	sb.WriteString(body + "\n")
+	for _, comment := range comments {
+		line := formatLineRange(comment)
+		fmt.Fprintf(&sb, "\n#### `%s:%s`\n\n%s\n", comment.Path, line, comment.Body)
+	}
+	return sb.String()
+}
+
+// mergeSameLineComments combines the comments anchored to the same lines of a file into one
+// comment listing each of them, so GitHub shows a single thread. The merged comment keeps the
+// anchor of the first one and the highest severity.
+func mergeSameLineComments(comments []Comment) []Comment {
+	type anchor struct {
+		path, side      string
+		startLine, line int
+	}
+	var order []anchor
+	groups := map[anchor][]Comment{}
+	for _, comment := range comments {
+		key := anchor{comment.Path, comment.Side, comment.StartLine, comment.Line}
+		if _, seen := groups[key]; !seen {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], comment)
+	}
+
+	merged := make([]Comment, 0, len(order))
+	for _, key := range order {
+		group := groups[key]
+		if len(group) == 1 {
+			merged = append(merged, group[0])
+			continue
+		}
+		comment := group[0]
+		bullets := make([]string, len(group))
+		for i, c := range group {
+			bullets[i] = "- " + strings.ReplaceAll(c.Body, "\n", "\n  ")
+			if severityRank(c.Severity) > severityRank(comment.Severity) {
+				comment.Severity = c.Severity
+			}
+		}
+		comment.Body = strings.Join(bullets, "\n")
+		merged = append(merged, comment)
+	}
+	return merged
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFindings(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []Finding
+	}{
+		{
+			name: "json array",
+			text: `[{"severity":"warning","comment":"Check the error","line":3}]`,
+			want: []Finding{{Severity: SeverityWarning, Comment: "Check the error", Line: 3}},
+		},
+		{
+			name: "fenced json",
+			text: "```json\n[{\"severity\":\"critical\",\"comment\":\"Nil dereference\",\"line\":7}]\n```",
+			want: []Finding{{Severity: SeverityCritical, Comment: "Nil dereference", Line: 7}},
+		},
+		{
+			name: "leading and trailing prose",
+			text: "Here are the issues I found:\n[{\"severity\":\"info\",\"comment\":\"Rename\",\"line\":2}]\nLet me know!",
+			want: []Finding{{Severity: SeverityInfo, Comment: "Rename", Line: 2}},
+		},
+		{
+			name: "prose around a fence",
+			text: "Sure:\n```\n[{\"severity\":\"warning\",\"comment\":\"Leak\",\"line\":4}]\n```\nDone.",
+			want: []Finding{{Severity: SeverityWarning, Comment: "Leak", Line: 4}},
+		},
+		{
+			name: "not json is kept as one comment",
+			text: "The code looks fine.",
+			want: []Finding{{Severity: SeverityInfo, Comment: "The code looks fine."}},
+		},
+		{
+			name: "empty comments dropped",
+			text: `[{"severity":"info","comment":" ","line":1}]`,
+			want: nil,
+		},
+		{
+			name: "unknown severity is info",
+			text: `[{"severity":"nitpick","comment":"Rename","line":1}]`,
+			want: []Finding{{Severity: SeverityInfo, Comment: "Rename", Line: 1}},
+		},
+		{
+			name: "truncated array keeps the complete findings",
+			text: `[{"severity":"info","comment":"First","line":1},{"severity":"warning","comment":"Second","line":2},{"severity":"info","comm`,
+			want: []Finding{{Severity: SeverityInfo, Comment: "First", Line: 1}, {Severity: SeverityWarning, Comment: "Second", Line: 2}},
+		},
+		{
+			name: "truncated fenced array",
+			text: "```json\n[{\"severity\":\"critical\",\"comment\":\"Leak\",\"line\":3},{\"sev",
+			want: []Finding{{Severity: SeverityCritical, Comment: "Leak", Line: 3}},
+		},
+		{
+			name: "empty array",
+			text: `[]`,
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseFindings(tt.text)
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseFindings() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitCommentsPerFile(t *testing.T) {
+	comments := []Comment{
+		{Path: "a.go", Line: 30, Severity: SeverityInfo, Body: "c"},
+		{Path: "a.go", Line: 20, Severity: SeverityCritical, Body: "a"},
+		{Path: "a.go", Line: 10, Severity: SeverityWarning, Body: "b"},
+		{Path: "b.go", Line: 5, Severity: SeverityInfo, Body: "d"},
+	}
+	tests := []struct {
+		name       string
+		maxPerFile int
+		wantLines  []int
+		wantNoteOn int // index of the comment with the omitted note, -1 for none
+	}{
+		{"unlimited", 0, []int{10, 20, 30, 5}, -1},
+		{"under the cap", 3, []int{10, 20, 30, 5}, -1},
+		{"most severe kept", 2, []int{10, 20, 5}, 1},
+		{"one per file", 1, []int{20, 5}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limited := limitCommentsPerFile(append([]Comment(nil), comments...), tt.maxPerFile)
+			sortComments(limited)
+
+			var lines []int
+			for _, comment := range limited {
+				lines = append(lines, comment.Line)
+			}
+			if !reflect.DeepEqual(lines, tt.wantLines) {
+				t.Fatalf("kept lines %v, want %v", lines, tt.wantLines)
+			}
+			// The note stays on the file's last comment once sorted
+			for i, comment := range limited {
+				if hasNote := strings.Contains(comment.Body, "lower-priority finding"); hasNote != (i == tt.wantNoteOn) {
+					t.Errorf("comment %d = %q, note expected %v", i, comment.Body, i == tt.wantNoteOn)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatFindingBody(t *testing.T) {
+	tests := []struct {
+		name           string
+		finding        Finding
+		withSuggestion bool
+		want           string
+	}{
+		{
+			name:    "plain",
+			finding: Finding{Severity: SeverityWarning, Comment: "Close the file"},
+			want:    "**Warning:** Close the file",
+		},
+		{
+			name:           "suggestion",
+			finding:        Finding{Severity: SeverityInfo, Comment: "Simplify", Suggestion: "return x\n"},
+			withSuggestion: true,
+			want:           "**Info:** Simplify\n\n```suggestion\nreturn x\n```",
+		},
+		{
+			name:    "suggestion left out",
+			finding: Finding{Severity: SeverityInfo, Comment: "Simplify", Suggestion: "return x"},
+			want:    "**Info:** Simplify",
+		},
+		{
+			name:    "rationale",
+			finding: Finding{Severity: SeverityCritical, Comment: "SQL injection", Rationale: "User input reaches the query."},
+			want:    "**Critical:** SQL injection\n\n<details>\n<summary>Why?</summary>\n\nUser input reaches the query.\n\n</details>",
+		},
+		{
+			name:           "rationale before the suggestion",
+			finding:        Finding{Severity: SeverityInfo, Comment: "Simplify", Rationale: "Shorter.", Suggestion: "return x\n"},
+			withSuggestion: true,
+			want:           "**Info:** Simplify\n\n<details>\n<summary>Why?</summary>\n\nShorter.\n\n</details>\n\n```suggestion\nreturn x\n```",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatFindingBody(tt.finding, tt.withSuggestion); got != tt.want {
+				t.Errorf("formatFindingBody() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatSuggestion(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"x := 1", "```suggestion\nx := 1\n```"},
+		{"s := \"```\"", "````suggestion\ns := \"```\"\n````"},
+		{"s := \"````\"", "`````suggestion\ns := \"````\"\n`````"},
+	}
+	for _, tt := range tests {
+		if got := formatSuggestion(tt.code); got != tt.want {
+			t.Errorf("formatSuggestion(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestFindingCommentSuggestion(t *testing.T) {
+	files, err := parseDiff(sampleDiff)
+	if err != nil {
+		t.Fatalf("parseDiff: %v", err)
+	}
+	hunk := files[0].Hunks[0]
+	tests := []struct {
+		name     string
+		finding  Finding
+		wantLine int
+		wantBody string
+	}{
+		{
+			name:     "on an added line",
+			finding:  Finding{Severity: SeverityInfo, Comment: "Wrap it", Line: 10, Suggestion: "log.Fatalf(\"run: %v\", err)"},
+			wantLine: 10,
+			wantBody: "**Info:** Wrap it\n\n```suggestion\nlog.Fatalf(\"run: %v\", err)\n```",
+		},
+		{
+			name:     "relocated without it",
+			finding:  Finding{Severity: SeverityInfo, Comment: "Wrap it", Line: 8, Suggestion: "ctx := context.TODO()"},
+			wantLine: 10,
+			wantBody: "**Info:** Wrap it",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			comment := findingComment("main.go", hunk, tt.finding)
+			if comment.Line != tt.wantLine || comment.Body != tt.wantBody {
+				t.Errorf("comment on %d: %q, want %d: %q", comment.Line, comment.Body, tt.wantLine, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestSortComments(t *testing.T) {
+	want := []Comment{
+		{Path: "a.go", Line: 2, Severity: SeverityCritical, Body: "1"},
+		{Path: "a.go", Line: 2, Severity: SeverityWarning, Body: "2"},
+		{Path: "a.go", Line: 2, Severity: SeverityInfo, Body: "3"},
+		{Path: "a.go", Line: 10, Severity: SeverityInfo, Body: "4"},
+		{Path: "b.go", Line: 1, Severity: SeverityWarning, Body: "5"},
+		{Path: "dir/a.go", Line: 1, Severity: SeverityInfo, Body: "6"},
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		comments := append([]Comment(nil), want...)
+		rng.Shuffle(len(comments), func(i, j int) { comments[i], comments[j] = comments[j], comments[i] })
+		sortComments(comments)
+		if !reflect.DeepEqual(comments, want) {
+			t.Fatalf("sorted to %+v, want %+v", comments, want)
+		}
+	}
+}
+
+func TestSplitInlineComments(t *testing.T) {
+	comments := []Comment{
+		{Path: "a.go", Line: 1, Severity: SeverityCritical},
+		{Path: "a.go", Line: 2, Severity: SeverityWarning},
+		{Path: "a.go", Line: 3, Severity: SeverityInfo},
+	}
+	tests := []struct {
+		minSeverity     string
+		inline, summary int
+	}{
+		{"", 3, 0},
+		{SeverityInfo, 3, 0},
+		{SeverityWarning, 2, 1},
+		{SeverityCritical, 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.minSeverity, func(t *testing.T) {
+			inline, summarized := splitInlineComments(comments, tt.minSeverity)
+			if len(inline) != tt.inline || len(summarized) != tt.summary {
+				t.Errorf("got %d inline, %d summarized, want %d, %d", len(inline), len(summarized), tt.inline, tt.summary)
+			}
+		})
+	}
+}
+
+func TestFormatCommentsBySeverity(t *testing.T) {
+	comments := []Comment{
+		{Path: "a.go", Line: 1, Severity: SeverityInfo, Body: "**Info:** one"},
+		{Path: "b.go", Line: 2, StartLine: 1, Severity: SeverityWarning, Body: "**Warning:** two"},
+		{Path: "c.go", Line: 3, Severity: SeverityInfo, Body: "**Info:** three"},
+	}
+	got := formatCommentsBySeverity(comments)
+
+	warning := strings.Index(got, "<summary>Warning (1)</summary>")
+	info := strings.Index(got, "<summary>Info (2)</summary>")
+	if warning < 0 || info < 0 || warning > info {
+		t.Fatalf("sections missing or out of order:\n%s", got)
+	}
+	if strings.Contains(got, "Critical") {
+		t.Errorf("empty critical section rendered:\n%s", got)
+	}
+	if !strings.Contains(got, "- `b.go:1-2` two") {
+		t.Errorf("multi-line finding not listed with its range:\n%s", got)
+	}
+}
+
+func TestFormatLineRange(t *testing.T) {
+	tests := []struct {
+		comment Comment
+		want    string
+	}{
+		{Comment{Line: 12}, "12"},
+		{Comment{StartLine: 10, Line: 12}, "10-12"},
+	}
+	for _, tt := range tests {
+		if got := formatLineRange(tt.comment); got != tt.want {
+			t.Errorf("formatLineRange(%+v) = %q, want %q", tt.comment, got, tt.want)
+		}
+	}
+}
+
+func TestMergeSameLineComments(t *testing.T) {
+	comments := []Comment{
+		{Path: "a.go", Line: 4, Side: SideRight, Severity: SeverityInfo, Body: "**Info:** first"},
+		{Path: "a.go", Line: 5, Side: SideRight, Severity: SeverityInfo, Body: "**Info:** other line"},
+		{Path: "a.go", Line: 4, Side: SideRight, Severity: SeverityCritical, Body: "**Critical:** second\ndetails"},
+		{Path: "a.go", Line: 4, Side: SideLeft, Severity: SeverityInfo, Body: "**Info:** removed line"},
+	}
+	want := []Comment{
+		{Path: "a.go", Line: 4, Side: SideRight, Severity: SeverityCritical, Body: "- **Info:** first\n- **Critical:** second\n  details"},
+		{Path: "a.go", Line: 5, Side: SideRight, Severity: SeverityInfo, Body: "**Info:** other line"},
+		{Path: "a.go", Line: 4, Side: SideLeft, Severity: SeverityInfo, Body: "**Info:** removed line"},
+	}
+	if got := mergeSameLineComments(comments); !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeSameLineComments() = %+v, want %+v", got, want)
+	}
+}
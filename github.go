@@ -0,0 +1,881 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	githubAPIBaseURL = "https://api.github.com"
+	// Maximum number of retries when GitHub answers with a secondary rate limit
+	maxRateLimitRetries = 3
+	// Retries of a review that GitHub failed with a 5xx, waiting twice as long each time
+	maxServerErrorRetries = 3
+	serverErrorRetryDelay = 2 * time.Second
+	// GitHub rejects comment bodies over 65536 characters, keep some headroom
+	maxCommentBodyLength = 65000
+	truncatedNotice      = "\n\n_(truncated)_"
+	// Connections that don't open or finish the TLS handshake in this time fail instead of hanging
+	dialTimeout         = 10 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// newHTTPClient returns the HTTP client shared by the GitHub and Gemini clients. Requests go through
+// proxyURL when set, otherwise through the proxy from HTTPS_PROXY/HTTP_PROXY/NO_PROXY, if any.
+func newHTTPClient(proxyURL string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = tlsHandshakeTimeout
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", proxyURL)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// withRequestTimeout returns a copy of client whose requests, including reading the response body,
+// fail after timeout. Gemini calls keep the shared client: long reviews can legitimately take minutes.
+func withRequestTimeout(client *http.Client, timeout time.Duration) *http.Client {
+	bounded := *client
+	bounded.Timeout = timeout
+	return &bounded
+}
+
+// Comment is a review comment on Line of the Side of the diff
+type Comment struct {
+	Path      string `json:"path"`
+	Line      int    `json:"line,omitempty"`
+	Side      string `json:"side,omitempty"`
+	StartLine int    `json:"start_line,omitempty"` // first line of a multi-line comment
+	StartSide string `json:"start_side,omitempty"`
+	Body      string `json:"body"`
+	Severity  string `json:"-"` // not part of the API payload
+	Model     string `json:"-"` // Gemini model that produced the comment
+	Prefix    string `json:"-"` // banner prepended to Body when posting, left out of the provenance hash
+}
+
+// MarshalJSON encodes a comment for the review API with its line and side, and the start of a
+// multi-line range only when there is one
+func (c Comment) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Path      string `json:"path"`
+		Line      int    `json:"line,omitempty"`
+		Side      string `json:"side,omitempty"`
+		StartLine int    `json:"start_line,omitempty"`
+		StartSide string `json:"start_side,omitempty"`
+		Body      string `json:"body"`
+	}{c.Path, c.Line, c.Side, c.StartLine, c.StartSide, c.Body})
+}
+
+// GitHubClient calls the GitHub REST API with a token
+type GitHubClient struct {
+	Token      string
+	BaseURL    string
+	HTTPClient *http.Client
+	// PR details read ahead with GraphQL, answering the matching REST reads. They are read
+	// before the review is posted, so the snapshot stays current for the whole run.
+	Snapshot *pullRequestSnapshot
+}
+
+// NewGitHubClient creates a client for api.github.com using httpClient for requests
+func NewGitHubClient(token string, httpClient *http.Client) *GitHubClient {
+	return &GitHubClient{
+		Token:      token,
+		BaseURL:    githubAPIBaseURL,
+		HTTPClient: httpClient,
+	}
+}
+
+// getDiff fetches the PR diff. GitHub refuses diffs that are too large, those are rebuilt from
+// the patches of the PR files instead.
+func (c *GitHubClient) getDiff(ctx context.Context, owner, repo string, pullNumber int) (string, error) {
+	url := fmt.Sprintf("%s/repos/%s/%s/pulls/%d", c.BaseURL, owner, repo, pullNumber)
+	diff, err := c.fetchDiff(ctx, url)
+	if !errors.Is(err, errDiffTooLarge) {
+		return diff, err
+	}
+	fmt.Println("The PR diff is too large for GitHub, building it from the PR files instead")
+	files, err := c.listPullRequestFiles(ctx, owner, repo, pullNumber)
+	if err != nil {
+		return "", err
+	}
+	return diffFromPullRequestFiles(files), nil
+}
+
+// pullRequestFile is a changed file as listed by the pull request files API
+type pullRequestFile struct {
+	Filename         string `json:"filename"`
+	PreviousFilename string `json:"previous_filename"`
+	Status           string `json:"status"`
+	Patch            string `json:"patch"`
+}
+
+// listPullRequestFiles fetches every changed file of a pull request with its patch
+func (c *GitHubClient) listPullRequestFiles(ctx context.Context, owner, repo string, pullNumber int) ([]pullRequestFile, error) {
+	const perPage = 100
+	var all []pullRequestFile
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/repos/%s/%s/pulls/%d/files?per_page=%d&page=%d", c.BaseURL, owner, repo, pullNumber, perPage, page)
+		var files []pullRequestFile
+		if err := c.doJSON(ctx, "GET", url, nil, http.StatusOK, &files); err != nil {
+			return nil, fmt.Errorf("failed to list PR files: %v", err)
+		}
+		all = append(all, files...)
+		if len(files) < perPage {
+			return all, nil
+		}
+	}
+}
+
+// parsedFilesFromPullRequestFiles converts the PR files listing straight into parsed files
+func parsedFilesFromPullRequestFiles(files []pullRequestFile) ([]ParsedFile, error) {
+	parsed := make([]ParsedFile, 0, len(files))
+	for _, file := range files {
+		hunks, err := parseFilePatch(file.Patch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the patch of %s: %v", file.Filename, err)
+		}
+		parsed = append(parsed, ParsedFile{
+			Path:    file.Filename,
+			Hunks:   hunks,
+			Added:   file.Status == "added",
+			Deleted: file.Status == "removed",
+			Binary:  file.Patch == "" && file.Status != "renamed",
+		})
+	}
+	return parsed, nil
+}
+
+// diffFromPullRequestFiles joins the file patches into a unified diff with the git headers
+// the files API leaves out. Files without a patch, binary or too large, are marked binary.
+func diffFromPullRequestFiles(files []pullRequestFile) string {
+	var sb strings.Builder
+	for _, file := range files {
+		oldPath := file.Filename
+		if file.PreviousFilename != "" {
+			oldPath = file.PreviousFilename
+		}
+		// A pure rename has nothing to review
+		if file.Patch == "" && file.Status == "renamed" {
+			continue
+		}
+		fmt.Fprintf(&sb, "diff --git a/%s b/%s\n", oldPath, file.Filename)
+		if file.Patch == "" {
+			fmt.Fprintf(&sb, "Binary files a/%s and b/%s differ\n", oldPath, file.Filename)
+			continue
+		}
+		if file.Status == "added" {
+			sb.WriteString("--- /dev/null\n")
+		} else {
+			fmt.Fprintf(&sb, "--- a/%s\n", oldPath)
+		}
+		if file.Status == "removed" {
+			sb.WriteString("+++ /dev/null\n")
+		} else {
+			fmt.Fprintf(&sb, "+++ b/%s\n", file.Filename)
+		}
+		sb.WriteString(file.Patch)
+		if !strings.HasSuffix(file.Patch, "\n") {
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+// getCompareDiff fetches the diff between two commits, as the PR shows it (base...head)
+func (c *GitHubClient) getCompareDiff(ctx context.Context, owner, repo, base, head string) (string, error) {
+	url := fmt.Sprintf("%s/repos/%s/%s/compare/%s...%s", c.BaseURL, owner, repo, base, head)
+	return c.fetchDiff(ctx, url)
+}
+
+// errDiffTooLarge is returned when GitHub refuses to render a diff because of its size
+var errDiffTooLarge = errors.New("diff too large")
+
+// fetchDiff requests url with the diff media type
+func (c *GitHubClient) fetchDiff(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Accept", "application/vnd.github.v3.diff")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	// GitHub answers 422 (or 406 for some endpoints) when the diff exceeds its size limits
+	if resp.StatusCode == http.StatusUnprocessableEntity || resp.StatusCode == http.StatusNotAcceptable {
+		return "", fmt.Errorf("%w: %s", errDiffTooLarge, string(body))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch diff: %s", string(body))
+	}
+
+	return string(body), nil
+}
+
+// Review events accepted by the review API, plus "AUTO" to derive one from the findings
+const (
+	ReviewEventComment        = "COMMENT"
+	ReviewEventApprove        = "APPROVE"
+	ReviewEventRequestChanges = "REQUEST_CHANGES"
+	ReviewEventAuto           = "AUTO"
+)
+
+// determineReviewEvent resolves the configured review event. In AUTO mode any critical finding
+// requests changes; otherwise the review approves when autoApprove is set and comments if not.
+func determineReviewEvent(mode string, comments []Comment, autoApprove bool) (string, error) {
+	switch mode = strings.ToUpper(strings.TrimSpace(mode)); mode {
+	case "":
+		return ReviewEventComment, nil
+	case ReviewEventComment, ReviewEventApprove, ReviewEventRequestChanges:
+		return mode, nil
+	case ReviewEventAuto:
+		for _, comment := range comments {
+			if comment.Severity == SeverityCritical {
+				return ReviewEventRequestChanges, nil
+			}
+		}
+		if autoApprove {
+			return ReviewEventApprove, nil
+		}
+		return ReviewEventComment, nil
+	default:
+		return "", fmt.Errorf("invalid review event %q", mode)
+	}
+}
+
+// postReviewComments submits a review. commitID is the head commit the comments were computed
+// against, so GitHub anchors them to that diff even if the PR moved on; empty uses the latest commit.
+// Every comment goes in the one create-review request, so they show up as a single review and
+// notify the PR author once, rather than being posted one by one.
+func (c *GitHubClient) postReviewComments(ctx context.Context, owner, repo string, pullNumber int, commitID, reviewEvent, reviewBody string, comments []Comment) error {
+	url := fmt.Sprintf("%s/repos/%s/%s/pulls/%d/reviews", c.BaseURL, owner, repo, pullNumber)
+	// The API expects an array, a body-only review sends an empty one rather than null
+	if comments == nil {
+		comments = []Comment{}
+	}
+	for i := range comments {
+		comments[i].Body = truncateCommentBody(comments[i].Body, maxCommentBodyLength)
+	}
+	payload := map[string]interface{}{
+		"body":     truncateCommentBody(reviewBody, maxCommentBodyLength),
+		"event":    reviewEvent,
+		"comments": comments,
+	}
+	if commitID != "" {
+		payload["commit_id"] = commitID
+	}
+	requestBody, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	// Log the URL and payload for debugging
+	fmt.Printf("Request URL: %s\n", url)
+	fmt.Printf("Request Body: %s\n", string(requestBody))
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(requestBody))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+			return nil
+		}
+
+		// Server errors are usually transient, back off and post the same review again
+		if resp.StatusCode >= http.StatusInternalServerError {
+			if attempt >= maxServerErrorRetries {
+				return fmt.Errorf("failed to post comments after %d attempts: %s: %s", attempt+1, resp.Status, string(body))
+			}
+			wait := serverErrorRetryDelay << attempt
+			fmt.Printf("GitHub answered %s, retrying in %s (%d/%d)\n", resp.Status, wait, attempt+1, maxServerErrorRetries)
+			if err := sleepContext(ctx, wait); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Secondary rate limits answer 403 or 429 with how long to wait in Retry-After
+		wait, limited := retryAfter(resp)
+		if !limited || attempt >= maxRateLimitRetries {
+			return fmt.Errorf("failed to post comments: %s", string(body))
+		}
+		fmt.Printf("Rate limited by GitHub, retrying in %s (%d/%d)\n", wait, attempt+1, maxRateLimitRetries)
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// truncateCommentBody shortens a body to at most limit characters, noting the truncation.
+// The provenance marker at the end of the body, if any, is kept. A code block the cut would leave
+// open, like a suggestion, is dropped as a whole since half a suggestion can't be applied.
+func truncateCommentBody(body string, limit int) string {
+	runes := []rune(body)
+	if len(runes) <= limit {
+		return body
+	}
+
+	suffix := truncatedNotice
+	if loc := provenanceMarkerRegex.FindStringIndex(body); loc != nil && strings.TrimSpace(body[loc[1]:]) == "" {
+		suffix += "\n\n" + body[loc[0]:loc[1]]
+	}
+	keep := limit - len([]rune(suffix))
+	if keep < 0 {
+		keep = 0
+	}
+	kept := string(runes[:keep])
+	if start := openFenceStart(kept); start >= 0 {
+		kept = strings.TrimRight(kept[:start], "\n")
+	}
+	return kept + suffix
+}
+
+// openFenceStart returns the offset of the line opening a code fence that text leaves unclosed,
+// or -1 when every fence is closed
+func openFenceStart(text string) int {
+	open, start := "", -1
+	offset := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		fence := trimmed[:len(trimmed)-len(strings.TrimLeft(trimmed, "`"))]
+		switch {
+		case open == "" && len(fence) >= 3:
+			open, start = fence, offset
+		case open != "" && len(fence) >= len(open) && trimmed == fence:
+			open, start = "", -1
+		}
+		offset += len(line)
+	}
+	return start
+}
+
+// retryAfter returns how long GitHub asks to wait before retrying a rate-limited request
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(strings.TrimSpace(resp.Header.Get("Retry-After")))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// sleepContext waits for d, returning early with the context error when ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// pullRequestInfo is the subset of the pull request API response the action uses
+type pullRequestInfo struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Draft bool   `json:"draft"`
+	User  struct {
+		Login string `json:"login"`
+	} `json:"user"`
+	Head struct {
+		SHA  string `json:"sha"`
+		Repo struct {
+			FullName string `json:"full_name"`
+		} `json:"repo"`
+	} `json:"head"`
+	Base struct {
+		SHA string `json:"sha"`
+	} `json:"base"`
+}
+
+// getPullRequest fetches a pull request, for triggers whose payload doesn't include it
+func (c *GitHubClient) getPullRequest(ctx context.Context, owner, repo string, pullNumber int) (*pullRequestInfo, error) {
+	if s := c.snapshotFor(owner, repo, pullNumber); s != nil {
+		return &s.Info, nil
+	}
+	url := fmt.Sprintf("%s/repos/%s/%s/pulls/%d", c.BaseURL, owner, repo, pullNumber)
+	var pr pullRequestInfo
+	if err := c.doJSON(ctx, "GET", url, nil, http.StatusOK, &pr); err != nil {
+		return nil, fmt.Errorf("failed to fetch pull request: %v", err)
+	}
+	return &pr, nil
+}
+
+// doJSON sends an authenticated request with an optional JSON body and decodes the JSON response into out
+func (c *GitHubClient) doJSON(ctx context.Context, method, url string, payload interface{}, wantStatus int, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewBuffer(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != wantStatus {
+		return fmt.Errorf("GitHub API returned %d: %s", resp.StatusCode, string(respBody))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// reviewComment is the subset of a pull request review comment the action uses.
+// Line is nil once the comment no longer applies to the current diff.
+type reviewComment struct {
+	ID          int64  `json:"id"`
+	NodeID      string `json:"node_id"`
+	Path        string `json:"path"`
+	Line        *int   `json:"line"`
+	Side        string `json:"side"`
+	Body        string `json:"body"`
+	InReplyToID int64  `json:"in_reply_to_id"` // 0 for the comment starting a thread
+	// Only known from GraphQL, threads listed through REST are considered open
+	Resolved bool `json:"-"`
+}
+
+// openThreads returns the ID of the first comment of each unresolved thread still on the diff,
+// by path, line and side
+func openThreads(comments []reviewComment) map[string]int64 {
+	threads := map[string]int64{}
+	for _, comment := range comments {
+		if comment.InReplyToID != 0 || comment.Line == nil || comment.Resolved {
+			continue
+		}
+		side := comment.Side
+		if side == "" {
+			side = SideRight
+		}
+		key := threadKey(comment.Path, *comment.Line, side)
+		if _, seen := threads[key]; !seen {
+			threads[key] = comment.ID
+		}
+	}
+	return threads
+}
+
+func threadKey(path string, line int, side string) string {
+	return fmt.Sprintf("%s:%d:%s", path, line, side)
+}
+
+// replyToComment adds a reply to the thread started by the review comment commentID
+func (c *GitHubClient) replyToComment(ctx context.Context, owner, repo string, pullNumber int, commentID int64, body string) error {
+	url := fmt.Sprintf("%s/repos/%s/%s/pulls/%d/comments/%d/replies", c.BaseURL, owner, repo, pullNumber, commentID)
+	payload := map[string]string{"body": truncateCommentBody(body, maxCommentBodyLength)}
+	if err := c.doJSON(ctx, "POST", url, payload, http.StatusCreated, nil); err != nil {
+		return fmt.Errorf("failed to reply to comment %d: %v", commentID, err)
+	}
+	return nil
+}
+
+// replyInOpenThreads posts the comments targeting a line with an open thread as replies to it,
+// keeping the discussion in one place, and returns the comments left for the review
+func (c *GitHubClient) replyInOpenThreads(ctx context.Context, owner, repo string, pullNumber int, comments []Comment) ([]Comment, error) {
+	existing, err := c.listReviewComments(ctx, owner, repo, pullNumber)
+	if err != nil {
+		return comments, err
+	}
+	threads := openThreads(existing)
+	if len(threads) == 0 {
+		return comments, nil
+	}
+
+	var remaining []Comment
+	for _, comment := range comments {
+		side := comment.Side
+		if side == "" {
+			side = SideRight
+		}
+		threadID, ok := threads[threadKey(comment.Path, comment.Line, side)]
+		if !ok || comment.StartLine != 0 {
+			remaining = append(remaining, comment)
+			continue
+		}
+		if err := c.replyToComment(ctx, owner, repo, pullNumber, threadID, comment.Body); err != nil {
+			return append(remaining, comment), err
+		}
+		fmt.Printf("Replied to the open thread on %s line %d\n", comment.Path, comment.Line)
+	}
+	return remaining, nil
+}
+
+// listReviewComments fetches every review comment of a pull request
+func (c *GitHubClient) listReviewComments(ctx context.Context, owner, repo string, pullNumber int) ([]reviewComment, error) {
+	if s := c.snapshotFor(owner, repo, pullNumber); s != nil {
+		return s.ReviewComments, nil
+	}
+	const perPage = 100
+	var all []reviewComment
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/repos/%s/%s/pulls/%d/comments?per_page=%d&page=%d", c.BaseURL, owner, repo, pullNumber, perPage, page)
+		var comments []reviewComment
+		if err := c.doJSON(ctx, "GET", url, nil, http.StatusOK, &comments); err != nil {
+			return nil, fmt.Errorf("failed to list review comments: %v", err)
+		}
+		all = append(all, comments...)
+		if len(comments) < perPage {
+			return all, nil
+		}
+	}
+}
+
+// pullReview is the part of a pull request review the action reads back
+type pullReview struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+}
+
+// listReviews fetches every review of a pull request
+func (c *GitHubClient) listReviews(ctx context.Context, owner, repo string, pullNumber int) ([]pullReview, error) {
+	if s := c.snapshotFor(owner, repo, pullNumber); s != nil {
+		return s.Reviews, nil
+	}
+	const perPage = 100
+	var all []pullReview
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s/repos/%s/%s/pulls/%d/reviews?per_page=%d&page=%d", c.BaseURL, owner, repo, pullNumber, perPage, page)
+		var reviews []pullReview
+		if err := c.doJSON(ctx, "GET", url, nil, http.StatusOK, &reviews); err != nil {
+			return nil, fmt.Errorf("failed to list reviews: %v", err)
+		}
+		all = append(all, reviews...)
+		if len(reviews) < perPage {
+			return all, nil
+		}
+	}
+}
+
+// hasIdenticalReview reports whether the action already posted a review with this fingerprint and
+// every one of its comments is still on the PR, so posting it again would only duplicate it
+func (c *GitHubClient) hasIdenticalReview(ctx context.Context, owner, repo string, pullNumber int, fingerprint string, comments []Comment) (bool, error) {
+	reviews, err := c.listReviews(ctx, owner, repo, pullNumber)
+	if err != nil {
+		return false, err
+	}
+	found := false
+	for _, review := range reviews {
+		if prior, ok := parseReviewBodyMarker(review.Body); ok && prior == fingerprint {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false, nil
+	}
+	if len(comments) == 0 {
+		return true, nil
+	}
+
+	existing, err := c.listReviewComments(ctx, owner, repo, pullNumber)
+	if err != nil {
+		return false, err
+	}
+	markers := make(map[string]bool, len(existing))
+	for _, comment := range existing {
+		if path, line, hash, ok := parseProvenanceMarker(comment.Body); ok {
+			markers[formatProvenanceMarker(path, line, hash)] = true
+		}
+	}
+	for _, comment := range comments {
+		path, line, hash, ok := parseProvenanceMarker(comment.Body)
+		if !ok || !markers[formatProvenanceMarker(path, line, hash)] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// minimizeComment hides a comment as outdated. Minimizing is only available through GraphQL.
+func (c *GitHubClient) minimizeComment(ctx context.Context, nodeID string) error {
+	payload := map[string]interface{}{
+		"query": `mutation($id: ID!) { minimizeComment(input: {subjectId: $id, classifier: OUTDATED}) { minimizedComment { isMinimized } } }`,
+		"variables": map[string]string{
+			"id": nodeID,
+		},
+	}
+	var result struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := c.doJSON(ctx, "POST", c.BaseURL+"/graphql", payload, http.StatusOK, &result); err != nil {
+		return fmt.Errorf("failed to minimize comment: %v", err)
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("failed to minimize comment: %s", result.Errors[0].Message)
+	}
+	return nil
+}
+
+// minimizeOutdatedComments hides the action's earlier comments that no longer apply to the diff
+// and returns how many were minimized
+func (c *GitHubClient) minimizeOutdatedComments(ctx context.Context, owner, repo string, pullNumber int) (int, error) {
+	comments, err := c.listReviewComments(ctx, owner, repo, pullNumber)
+	if err != nil {
+		return 0, err
+	}
+
+	minimized := 0
+	for _, comment := range comments {
+		if comment.Line != nil || !hasReviewMarker(comment.Body) {
+			continue
+		}
+		if err := c.minimizeComment(ctx, comment.NodeID); err != nil {
+			return minimized, err
+		}
+		minimized++
+	}
+	return minimized, nil
+}
+
+// GitHubProvider reviews a GitHub pull request
+type GitHubProvider struct {
+	Client    *GitHubClient
+	PR        *PRDetails
+	EventName string
+	// Explicit commit range to review instead of the PR diff, both set or both empty
+	BaseSHA string
+	HeadSHA string
+	// Branch or commit to diff the PR head against instead of the PR base
+	CompareBase string
+
+	ReviewEventMode  string
+	AutoApprove      bool
+	OutputMode       string
+	AnnotationLevels map[string]string
+	MinimizeComments bool
+	// Build the parsed files from the PR files API instead of requesting the diff
+	UseFilesAPI bool
+	// Reply to open threads on the commented lines instead of starting new ones
+	ReplyToThreads bool
+}
+
+// FetchDiff fetches the diff to review. An explicit commit range or compare base takes precedence
+// over the PR diff. pull_request_target runs in the context of the base repository, so its diff is
+// pinned to the commits from the payload rather than whatever the PR points to when the job runs.
+func (p *GitHubProvider) FetchDiff(ctx context.Context) (string, error) {
+	pr := p.PR
+	switch {
+	case p.BaseSHA != "":
+		fmt.Printf("Reviewing the commit range %s...%s\n", p.BaseSHA, p.HeadSHA)
+		return p.Client.getCompareDiff(ctx, pr.Owner, pr.Repo, p.BaseSHA, p.HeadSHA)
+	case p.CompareBase != "":
+		if pr.HeadSHA == "" {
+			return "", fmt.Errorf("INPUT_COMPARE_BASE is set but the PR head commit is unknown")
+		}
+		fmt.Printf("Reviewing the PR head against %s\n", p.CompareBase)
+		return p.Client.getCompareDiff(ctx, pr.Owner, pr.Repo, p.CompareBase, pr.HeadSHA)
+	// Commits of fork PRs are reachable from the base repository through its pull refs,
+	// so comparing SHAs works there too.
+	case p.EventName == eventPullRequestTarget && pr.HeadSHA != "" && pr.BaseSHA != "":
+		return p.Client.getCompareDiff(ctx, pr.Owner, pr.Repo, pr.BaseSHA, pr.HeadSHA)
+	default:
+		return p.Client.getDiff(ctx, pr.Owner, pr.Repo, pr.PullNumber)
+	}
+}
+
+// FetchParsedFiles lists the PR files with their patches when UseFilesAPI is set, saving the diff
+// request. Commit ranges and compare bases aren't PR files, they go through FetchDiff.
+func (p *GitHubProvider) FetchParsedFiles(ctx context.Context) ([]ParsedFile, error) {
+	if !p.UseFilesAPI || p.BaseSHA != "" || p.CompareBase != "" {
+		diff, err := p.FetchDiff(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return parseDiff(diff)
+	}
+	files, err := p.Client.listPullRequestFiles(ctx, p.PR.Owner, p.PR.Repo, p.PR.PullNumber)
+	if err != nil {
+		return nil, err
+	}
+	return parsedFilesFromPullRequestFiles(files)
+}
+
+// commitID is the head commit that was reviewed, so the comments anchor to its diff
+func (p *GitHubProvider) commitID() string {
+	if p.HeadSHA != "" {
+		return p.HeadSHA
+	}
+	return p.PR.HeadSHA
+}
+
+// PostReview submits a pull request review, creates a check run with annotations in checks mode,
+// or only sets a commit status in status-only mode
+func (p *GitHubProvider) PostReview(ctx context.Context, body string, comments []Comment) error {
+	return p.PostReviewWithConclusion(ctx, body, comments, "")
+}
+
+// PostReviewWithConclusion is PostReview for a review that didn't cover the whole PR. The check run
+// or commit status gets conclusion, or the conclusion of the comments when it is worse, and the
+// review is never an approval. An empty conclusion is derived from the comments alone.
+func (p *GitHubProvider) PostReviewWithConclusion(ctx context.Context, body string, comments []Comment, conclusion string) error {
+	pr := p.PR
+	incomplete := conclusion != ""
+	if derived := checkConclusion(p.AnnotationLevels, comments); conclusionRank(derived) >= conclusionRank(conclusion) {
+		conclusion = derived
+	}
+	if p.OutputMode == outputModeChecks {
+		if err := p.Client.createCheckRun(ctx, pr.Owner, pr.Repo, p.commitID(), conclusion, body, commentsToAnnotations(p.AnnotationLevels, comments)); err != nil {
+			return err
+		}
+		fmt.Printf("Check run created with conclusion %s.\n", conclusion)
+		return nil
+	}
+	if p.OutputMode == outputModeStatusOnly {
+		sha := p.commitID()
+		if sha == "" {
+			return fmt.Errorf("the PR head commit is unknown, can't set a commit status")
+		}
+		state := commitStatusState(conclusion, incomplete)
+		if err := p.Client.createCommitStatus(ctx, pr.Owner, pr.Repo, sha, state, commitStatusDescription(comments, incomplete)); err != nil {
+			return err
+		}
+		fmt.Printf("Commit status set to %s, no comments posted.\n", state)
+		return nil
+	}
+
+	comments = addReviewMarker(comments)
+
+	// Re-runs on the same diff would post the same review again
+	fingerprint := reviewFingerprint(body, comments)
+	duplicate, err := p.Client.hasIdenticalReview(ctx, pr.Owner, pr.Repo, pr.PullNumber, fingerprint, comments)
+	if err != nil {
+		fmt.Println("Warning: failed to check for an identical earlier review:", err)
+	} else if duplicate {
+		fmt.Println("An identical review was already posted. Nothing to post.")
+		return nil
+	}
+	body += "\n\n" + formatReviewBodyMarker(fingerprint)
+
+	reviewEvent, _ := determineReviewEvent(p.ReviewEventMode, comments, p.AutoApprove)
+	if incomplete && reviewEvent == ReviewEventApprove {
+		reviewEvent = ReviewEventComment
+	}
+
+	// Comments on a line already under discussion join that thread instead of starting another
+	if p.ReplyToThreads {
+		remaining, err := p.Client.replyInOpenThreads(ctx, pr.Owner, pr.Repo, pr.PullNumber, comments)
+		if err != nil {
+			fmt.Println("Warning:", err)
+		}
+		comments = remaining
+	}
+
+	fmt.Printf("Submitting review with event %s\n", reviewEvent)
+	return p.Client.postReviewComments(ctx, pr.Owner, pr.Repo, pr.PullNumber, p.commitID(), reviewEvent, body, comments)
+}
+
+// PriorCommentBodies returns the bodies of the review comments already on the pull request
+func (p *GitHubProvider) PriorCommentBodies(ctx context.Context) ([]string, error) {
+	comments, err := p.Client.listReviewComments(ctx, p.PR.Owner, p.PR.Repo, p.PR.PullNumber)
+	if err != nil {
+		return nil, err
+	}
+	bodies := make([]string, len(comments))
+	for i, comment := range comments {
+		bodies[i] = comment.Body
+	}
+	return bodies, nil
+}
+
+// MinimizeOutdated hides the action's earlier comments that no longer apply to the diff
+func (p *GitHubProvider) MinimizeOutdated(ctx context.Context) (int, error) {
+	if !p.MinimizeComments {
+		return 0, nil
+	}
+	return p.Client.minimizeOutdatedComments(ctx, p.PR.Owner, p.PR.Repo, p.PR.PullNumber)
+}
+
+// getFileContent fetches a file of the repository at ref, or at the default branch when ref is
+// empty. It returns nil without error when the file doesn't exist.
+func (c *GitHubClient) getFileContent(ctx context.Context, owner, repo, path, ref string) ([]byte, error) {
+	fileURL := fmt.Sprintf("%s/repos/%s/%s/contents/%s", c.BaseURL, owner, repo, path)
+	if ref != "" {
+		fileURL += "?ref=" + url.QueryEscape(ref)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Accept", "application/vnd.github.raw")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("failed to fetch %s: GitHub API returned %d: %s", path, resp.StatusCode, string(body))
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGitHub serves the reviews and review comments of pull request o/r#1 a page at a time, and
+// records the JSON payloads posted to any path, answering them with 201
+type fakeGitHub struct {
+	mu       sync.Mutex
+	reviews  []pullReview
+	comments []reviewComment
+	posts    map[string][]map[string]interface{}
+}
+
+func newFakeGitHub(t *testing.T) (*fakeGitHub, *GitHubClient) {
+	t.Helper()
+	fake := &fakeGitHub{posts: map[string][]map[string]interface{}{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	client := NewGitHubClient("token", srv.Client())
+	client.BaseURL = srv.URL
+	return fake, client
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Method != http.MethodGet {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		f.posts[r.URL.Path] = append(f.posts[r.URL.Path], payload)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":1}`))
+		return
+	}
+
+	var items []interface{}
+	switch r.URL.Path {
+	case "/repos/o/r/pulls/1/reviews":
+		for _, review := range f.reviews {
+			items = append(items, review)
+		}
+	case "/repos/o/r/pulls/1/comments":
+		for _, comment := range f.comments {
+			items = append(items, comment)
+		}
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if page < 1 || perPage < 1 {
+		page, perPage = 1, len(items)+1
+	}
+	start, end := (page-1)*perPage, page*perPage
+	if start > len(items) {
+		start = len(items)
+	}
+	if end > len(items) {
+		end = len(items)
+	}
+	json.NewEncoder(w).Encode(append([]interface{}{}, items[start:end]...))
+}
+
+// postCount returns how many payloads were posted to path
+func (f *fakeGitHub) postCount(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.posts[path])
+}
+
+func TestDetermineReviewEvent(t *testing.T) {
+	critical := []Comment{{Severity: SeverityCritical}}
+	info := []Comment{{Severity: SeverityInfo}}
+	tests := []struct {
+		mode        string
+		comments    []Comment
+		autoApprove bool
+		want        string
+		wantErr     bool
+	}{
+		{"", critical, true, ReviewEventComment, false},
+		{"approve", nil, false, ReviewEventApprove, false},
+		{ReviewEventAuto, critical, true, ReviewEventRequestChanges, false},
+		{ReviewEventAuto, info, true, ReviewEventApprove, false},
+		{ReviewEventAuto, info, false, ReviewEventComment, false},
+		{"merge", nil, false, "", true},
+	}
+	for _, tt := range tests {
+		got, err := determineReviewEvent(tt.mode, tt.comments, tt.autoApprove)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("determineReviewEvent(%q, %v, %v) = %q, %v, want %q", tt.mode, tt.comments, tt.autoApprove, got, err, tt.want)
+		}
+	}
+}
+
+func TestPostReviewCommentsRateLimited(t *testing.T) {
+	tests := []struct {
+		name         string
+		limited      int    // rate-limited answers before the review is accepted
+		retryAfter   string // Retry-After sent with them
+		wantRequests int
+		wantErr      bool
+		minWait      time.Duration
+	}{
+		{"retried after the wait", 1, "1", 2, false, time.Second},
+		{"retries capped", maxRateLimitRetries + 1, "0", maxRateLimitRetries + 1, true, 0},
+		{"forbidden without Retry-After", 1, "", 1, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests <= tt.limited {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					http.Error(w, `{"message":"You have exceeded a secondary rate limit"}`, http.StatusForbidden)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"id":1}`))
+			}))
+			defer srv.Close()
+
+			client := NewGitHubClient("token", srv.Client())
+			client.BaseURL = srv.URL
+			start := time.Now()
+			err := client.postReviewComments(context.Background(), "octo", "repo", 1, "", ReviewEventComment, "body", []Comment{{Path: "a.go", Line: 1, Body: "x"}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "secondary rate limit") {
+				t.Errorf("err = %v, want GitHub's message", err)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("got %d requests, want %d", requests, tt.wantRequests)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minWait {
+				t.Errorf("retried after %s, want at least %s", elapsed, tt.minWait)
+			}
+		})
+	}
+}
+
+func TestTruncateCommentBody(t *testing.T) {
+	marker := formatProvenanceMarker("a.go", 3, "abcdef")
+	tests := []struct {
+		name  string
+		body  string
+		limit int
+		want  string
+	}{
+		{"short", "fits", 10, "fits"},
+		{"cut", strings.Repeat("a", 30), 20, strings.Repeat("a", 20-len(truncatedNotice)) + truncatedNotice},
+		{
+			name:  "marker kept",
+			body:  strings.Repeat("a", 100) + "\n\n" + marker,
+			limit: 80,
+			want:  strings.Repeat("a", 80-len(truncatedNotice)-2-len(marker)) + truncatedNotice + "\n\n" + marker,
+		},
+		{
+			name:  "open fence dropped",
+			body:  "Fix it:\n\n```suggestion\n" + strings.Repeat("x\n", 40) + "```",
+			limit: 50,
+			want:  "Fix it:" + truncatedNotice,
+		},
+		{
+			name:  "closed fence kept",
+			body:  "```go\nx\n```\n" + strings.Repeat("y", 60),
+			limit: 40,
+			want:  "```go\nx\n```\n" + strings.Repeat("y", 40-12-len(truncatedNotice)) + truncatedNotice,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateCommentBody(tt.body, tt.limit)
+			if got != tt.want {
+				t.Errorf("truncateCommentBody() = %q, want %q", got, tt.want)
+			}
+			if len([]rune(got)) > tt.limit {
+				t.Errorf("got %d characters, limit %d", len([]rune(got)), tt.limit)
+			}
+		})
+	}
+}
+
+func TestOpenFenceStart(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"no fence", -1},
+		{"a\n```go\nx\n```\n", -1},
+		{"a\n```go\nx\n", 2},
+		{"````\n```\nx\n", 0},
+		{"````\n```\n````\n", -1},
+	}
+	for _, tt := range tests {
+		if got := openFenceStart(tt.text); got != tt.want {
+			t.Errorf("openFenceStart(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestPostReviewCommentsTruncatesLongBodies(t *testing.T) {
+	var posted struct {
+		Body     string    `json:"body"`
+		Comments []Comment `json:"comments"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&posted); err != nil {
+			t.Errorf("decoding the review: %v", err)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":1}`))
+	}))
+	defer srv.Close()
+
+	client := NewGitHubClient("token", srv.Client())
+	client.BaseURL = srv.URL
+	long := strings.Repeat("a", maxCommentBodyLength+100)
+	comments := []Comment{{Path: "a.go", Line: 1, Side: SideRight, Body: long}}
+	if err := client.postReviewComments(context.Background(), "octo", "repo", 1, "", ReviewEventComment, long, comments); err != nil {
+		t.Fatalf("postReviewComments: %v", err)
+	}
+	if len(posted.Comments) != 1 {
+		t.Fatalf("posted %d comments, want 1", len(posted.Comments))
+	}
+	for _, body := range []string{posted.Body, posted.Comments[0].Body} {
+		if len([]rune(body)) > maxCommentBodyLength || !strings.HasSuffix(body, truncatedNotice) {
+			t.Errorf("posted a %d character body, want it truncated to %d with a notice", len([]rune(body)), maxCommentBodyLength)
+		}
+	}
+}
+
+func TestWithRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body" {
+			// Headers arrive in time, the body stalls
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	shared := srv.Client()
+	client := NewGitHubClient("token", withRequestTimeout(shared, 100*time.Millisecond))
+	client.BaseURL = srv.URL
+	if shared.Timeout != 0 {
+		t.Errorf("shared client Timeout = %s, want it left unbounded for Gemini", shared.Timeout)
+	}
+
+	for _, path := range []string{"/slow", "/slow-body"} {
+		start := time.Now()
+		_, err := client.fetchDiff(context.Background(), srv.URL+path)
+		if err == nil {
+			t.Errorf("%s: request succeeded, want a timeout", path)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: failed after %s, want it to fail fast", path, elapsed)
+		}
+	}
+}
+
+func TestPostReviewSkipsIdenticalReview(t *testing.T) {
+	newComments := func() []Comment {
+		return []Comment{
+			{Path: "a.go", Line: 2, Side: SideRight, Severity: SeverityWarning, Body: "**Warning:** x"},
+			{Path: "b.go", Line: 5, Side: SideRight, Severity: SeverityInfo, Body: "**Info:** y"},
+		}
+	}
+	// The earlier run, with enough unrelated reviews and comments before it to need a second page
+	marked := addReviewMarker(newComments())
+	fingerprint := reviewFingerprint("Summary", marked)
+	var reviews []pullReview
+	var priorComments []reviewComment
+	for i := 0; i < 120; i++ {
+		reviews = append(reviews, pullReview{ID: int64(i), Body: "LGTM"})
+		priorComments = append(priorComments, reviewComment{ID: int64(i), Path: "c.go", Body: "human comment"})
+	}
+	reviews = append(reviews, pullReview{ID: 500, Body: "Summary\n\n" + formatReviewBodyMarker(fingerprint)})
+	for i, comment := range marked {
+		priorComments = append(priorComments, reviewComment{ID: int64(500 + i), Path: comment.Path, Body: comment.Body})
+	}
+
+	tests := []struct {
+		name      string
+		body      string
+		comments  []reviewComment
+		wantPosts int
+	}{
+		{"identical review", "Summary", priorComments, 0},
+		{"different body", "Other summary", priorComments, 1},
+		{"a comment was deleted", "Summary", priorComments[:len(priorComments)-1], 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeGitHub(t)
+			fake.reviews = reviews
+			fake.comments = tt.comments
+			provider := &GitHubProvider{Client: client, PR: &PRDetails{Owner: "o", Repo: "r", PullNumber: 1}, OutputMode: outputModeReview}
+			if err := provider.PostReview(context.Background(), tt.body, newComments()); err != nil {
+				t.Fatalf("PostReview: %v", err)
+			}
+			if got := fake.postCount("/repos/o/r/pulls/1/reviews"); got != tt.wantPosts {
+				t.Errorf("posted %d reviews, want %d", got, tt.wantPosts)
+			}
+		})
+	}
+}
+
+func TestGetDiffTooLargeFallsBackToFiles(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		switch r.URL.Path {
+		case "/repos/o/r/pulls/1":
+			if r.Header.Get("Accept") != "application/vnd.github.v3.diff" {
+				t.Errorf("Accept = %q, want the diff media type", r.Header.Get("Accept"))
+			}
+			http.Error(w, `{"message":"Sorry, the diff exceeded the maximum number of lines (20000)"}`, http.StatusUnprocessableEntity)
+		case "/repos/o/r/pulls/1/files":
+			json.NewEncoder(w).Encode([]pullRequestFile{
+				{Filename: "main.go", Status: "modified", Patch: "@@ -1,2 +1,2 @@\n package main\n-var a = 1\n+var a = 2"},
+				{Filename: "new.go", Status: "added", Patch: "@@ -0,0 +1 @@\n+package main"},
+				{Filename: "logo.png", Status: "modified"},
+				{Filename: "moved.go", PreviousFilename: "old.go", Status: "renamed"},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	client := NewGitHubClient("token", srv.Client())
+	client.BaseURL = srv.URL
+	diff, err := client.getDiff(context.Background(), "o", "r", 1)
+	if err != nil {
+		t.Fatalf("getDiff: %v", err)
+	}
+	if want := []string{"/repos/o/r/pulls/1", "/repos/o/r/pulls/1/files"}; strings.Join(requests, " ") != strings.Join(want, " ") {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+
+	files, err := parseDiff(diff)
+	if err != nil {
+		t.Fatalf("parseDiff: %v\n%s", err, diff)
+	}
+	var got []string
+	for _, file := range files {
+		got = append(got, fmt.Sprintf("%s added=%v binary=%v hunks=%d", file.Path, file.Added, file.Binary, len(file.Hunks)))
+	}
+	want := []string{"main.go added=false binary=false hunks=1", "new.go added=true binary=false hunks=1", "logo.png added=false binary=true hunks=0"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("files =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestPostReviewCommentPrefix(t *testing.T) {
+	fake, client := newFakeGitHub(t)
+	provider := &GitHubProvider{Client: client, PR: &PRDetails{Owner: "o", Repo: "r", PullNumber: 1}, OutputMode: outputModeReview}
+	newComments := func(prefix string) []Comment {
+		return []Comment{{Path: "a.go", Line: 2, Side: SideRight, Severity: SeverityInfo, Prefix: prefix, Body: "**Info:** x"}}
+	}
+	if err := provider.PostReview(context.Background(), "Summary", newComments("🤖 Gemini:")); err != nil {
+		t.Fatalf("PostReview: %v", err)
+	}
+	review := fake.posts["/repos/o/r/pulls/1/reviews"][0]
+	body := review["comments"].([]interface{})[0].(map[string]interface{})["body"].(string)
+	if !strings.HasPrefix(body, "🤖 Gemini: **Info:** x") {
+		t.Errorf("comment body = %q, want it prefixed", body)
+	}
+
+	// The next run, with the prefix changed, finds the review it posted
+	fake.reviews = []pullReview{{ID: 1, Body: review["body"].(string)}}
+	fake.comments = []reviewComment{{ID: 2, Path: "a.go", Body: body}}
+	if err := provider.PostReview(context.Background(), "Summary", newComments("")); err != nil {
+		t.Fatalf("PostReview: %v", err)
+	}
+	if got := fake.postCount("/repos/o/r/pulls/1/reviews"); got != 1 {
+		t.Errorf("posted %d reviews, want the identical one skipped", got)
+	}
+}
+
+func TestPostReviewRepliesToOpenThreads(t *testing.T) {
+	fake, client := newFakeGitHub(t)
+	line := 2
+	fake.comments = []reviewComment{
+		{ID: 7, Path: "a.go", Line: &line, Side: SideRight, Body: "Earlier finding"},
+		{ID: 8, Path: "a.go", Line: &line, Side: SideRight, Body: "Answer", InReplyToID: 7},
+	}
+	provider := &GitHubProvider{Client: client, PR: &PRDetails{Owner: "o", Repo: "r", PullNumber: 1}, OutputMode: outputModeReview, ReplyToThreads: true}
+	comments := []Comment{
+		{Path: "a.go", Line: 2, Side: SideRight, Severity: SeverityWarning, Body: "**Warning:** still unhandled"},
+		{Path: "a.go", Line: 5, Side: SideRight, Severity: SeverityInfo, Body: "**Info:** new"},
+	}
+	if err := provider.PostReview(context.Background(), "Summary", comments); err != nil {
+		t.Fatalf("PostReview: %v", err)
+	}
+
+	replies := fake.posts["/repos/o/r/pulls/1/comments/7/replies"]
+	if len(replies) != 1 || !strings.HasPrefix(replies[0]["body"].(string), "**Warning:** still unhandled") {
+		t.Errorf("replies to thread 7 = %v, want the finding on its line", replies)
+	}
+	if got := fake.postCount("/repos/o/r/pulls/1/comments/8/replies"); got != 0 {
+		t.Errorf("replied %d times to comment 8, want replies sent to the thread's first comment", got)
+	}
+	review := fake.posts["/repos/o/r/pulls/1/reviews"][0]
+	inline := review["comments"].([]interface{})
+	if len(inline) != 1 || inline[0].(map[string]interface{})["line"] != float64(5) {
+		t.Errorf("review comments = %v, want only the finding on line 5", inline)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// createAppJWT creates the short-lived RS256 JWT a GitHub App uses to authenticate as itself
+func createAppJWT(appID string, privateKeyPEM string, now time.Time) (string, error) {
+	key, err := parseRSAPrivateKey(privateKeyPEM)
+	if err != nil {
+		return "", err
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		// Backdate to allow for clock drift, GitHub accepts at most 10 minutes of validity
+		"iat": now.Add(-60 * time.Second).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appID,
+	})
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign app JWT: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseRSAPrivateKey reads a PKCS#1 or PKCS#8 RSA private key, as downloaded from the GitHub App settings
+func parseRSAPrivateKey(privateKeyPEM string) (*rsa.PrivateKey, error) {
+	// Secrets are sometimes stored with escaped newlines
+	privateKeyPEM = strings.ReplaceAll(privateKeyPEM, `\n`, "\n")
+	block, _ := pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return nil, errors.New("app private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse app private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("app private key is not an RSA key")
+	}
+	return key, nil
+}
+
+// createInstallationToken exchanges the app JWT for an installation access token scoped to owner/repo
+func (c *GitHubClient) createInstallationToken(ctx context.Context, appJWT, owner, repo string) (string, error) {
+	var installation struct {
+		ID int64 `json:"id"`
+	}
+	url := fmt.Sprintf("%s/repos/%s/%s/installation", c.BaseURL, owner, repo)
+	if err := c.doAppRequest(ctx, "GET", url, appJWT, http.StatusOK, &installation); err != nil {
+		return "", fmt.Errorf("failed to find the app installation for %s/%s: %v", owner, repo, err)
+	}
+
+	var token struct {
+		Token string `json:"token"`
+	}
+	url = fmt.Sprintf("%s/app/installations/%d/access_tokens", c.BaseURL, installation.ID)
+	if err := c.doAppRequest(ctx, "POST", url, appJWT, http.StatusCreated, &token); err != nil {
+		return "", fmt.Errorf("failed to create an installation token: %v", err)
+	}
+	if token.Token == "" {
+		return "", errors.New("installation token response has no token")
+	}
+	return token.Token, nil
+}
+
+// doAppRequest sends a request authenticated as the app and decodes the JSON response into out
+func (c *GitHubClient) doAppRequest(ctx context.Context, method, url, appJWT string, wantStatus int, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+appJWT)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != wantStatus {
+		return fmt.Errorf("GitHub API returned %d: %s", resp.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, out)
+}
+
+// useAppInstallationToken mints an installation token for the repository and uses it for
+// subsequent API calls in place of INPUT_GITHUB_TOKEN
+func (c *GitHubClient) useAppInstallationToken(ctx context.Context, appID, privateKeyPEM, owner, repo string) error {
+	appJWT, err := createAppJWT(appID, privateKeyPEM, time.Now())
+	if err != nil {
+		return err
+	}
+	token, err := c.createInstallationToken(ctx, appJWT, owner, repo)
+	if err != nil {
+		return err
+	}
+	c.Token = token
+	return nil
+}
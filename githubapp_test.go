@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAppKey returns a fresh RSA key and its PKCS#1 PEM encoding
+func newTestAppKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	return key, string(pem.EncodeToMemory(block))
+}
+
+// verifyAppJWT checks the JWT signature against key and returns its claims
+func verifyAppJWT(t *testing.T, token string, key *rsa.PrivateKey) map[string]interface{} {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("JWT has %d parts, want 3", len(parts))
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("decoding the signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatalf("JWT signature does not verify: %v", err)
+	}
+
+	var header map[string]string
+	decodeJWTPart(t, parts[0], &header)
+	if header["alg"] != "RS256" || header["typ"] != "JWT" {
+		t.Errorf("header = %v, want RS256 JWT", header)
+	}
+	var claims map[string]interface{}
+	decodeJWTPart(t, parts[1], &claims)
+	return claims
+}
+
+func decodeJWTPart(t *testing.T, part string, out interface{}) {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", part, err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		t.Fatalf("unmarshaling %s: %v", data, err)
+	}
+}
+
+func TestCreateAppJWT(t *testing.T) {
+	key, keyPEM := newTestAppKey(t)
+	now := time.Unix(1700000000, 0)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		pem  string
+	}{
+		{"pkcs1", keyPEM},
+		{"pkcs8", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))},
+		{"escaped newlines", strings.ReplaceAll(keyPEM, "\n", `\n`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := createAppJWT("12345", tt.pem, now)
+			if err != nil {
+				t.Fatalf("createAppJWT: %v", err)
+			}
+			claims := verifyAppJWT(t, token, key)
+			if claims["iss"] != "12345" {
+				t.Errorf("iss = %v, want 12345", claims["iss"])
+			}
+			if iat := claims["iat"].(float64); int64(iat) != now.Unix()-60 {
+				t.Errorf("iat = %v, want a minute before now", iat)
+			}
+			if exp := claims["exp"].(float64); int64(exp) != now.Add(9*time.Minute).Unix() {
+				t.Errorf("exp = %v, want nine minutes after now", exp)
+			}
+		})
+	}
+
+	if _, err := createAppJWT("12345", "not a key", now); err == nil {
+		t.Error("createAppJWT accepted a key that is not PEM encoded")
+	}
+}
+
+func TestUseAppInstallationToken(t *testing.T) {
+	key, keyPEM := newTestAppKey(t)
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			t.Errorf("%s %s: Authorization = %q, want a bearer JWT", r.Method, r.URL.Path, auth)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if claims := verifyAppJWT(t, strings.TrimPrefix(auth, "Bearer "), key); claims["iss"] != "12345" {
+			t.Errorf("iss = %v, want 12345", claims["iss"])
+		}
+
+		switch r.Method + " " + r.URL.Path {
+		case "GET /repos/octo/repo/installation":
+			w.Write([]byte(`{"id":42}`))
+		case "POST /app/installations/42/access_tokens":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"token":"ghs_installation"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	client := NewGitHubClient("workflow-token", srv.Client())
+	client.BaseURL = srv.URL
+	if err := client.useAppInstallationToken(context.Background(), "12345", keyPEM, "octo", "repo"); err != nil {
+		t.Fatalf("useAppInstallationToken: %v", err)
+	}
+	if client.Token != "ghs_installation" {
+		t.Errorf("Token = %q, want the installation token", client.Token)
+	}
+	want := []string{"GET /repos/octo/repo/installation", "POST /app/installations/42/access_tokens"}
+	if strings.Join(requests, ", ") != strings.Join(want, ", ") {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+}
+
+func TestUseAppInstallationTokenNotInstalled(t *testing.T) {
+	_, keyPEM := newTestAppKey(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	client := NewGitHubClient("workflow-token", srv.Client())
+	client.BaseURL = srv.URL
+	err := client.useAppInstallationToken(context.Background(), "12345", keyPEM, "octo", "repo")
+	if err == nil || !strings.Contains(err.Error(), "failed to find the app installation for octo/repo") {
+		t.Errorf("err = %v, want a missing installation error", err)
+	}
+	if client.Token != "workflow-token" {
+		t.Errorf("Token = %q, want the workflow token kept", client.Token)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const gitlabAPIBaseURL = "https://gitlab.com/api/v4"
+
+// GitLabProvider reviews a GitLab merge request through the GitLab REST API
+type GitLabProvider struct {
+	Token           string
+	BaseURL         string // API root, e.g. https://gitlab.com/api/v4
+	ProjectID       string // numeric ID or "group/project" path
+	MergeRequestIID int
+	HTTPClient      *http.Client
+
+	Title       string
+	Description string
+	diffRefs    gitlabDiffRefs
+	oldPaths    map[string]string // old path of each changed file, by new path
+}
+
+// gitlabDiffRefs are the commits a merge request diff is computed from, needed to position comments
+type gitlabDiffRefs struct {
+	BaseSHA  string `json:"base_sha"`
+	HeadSHA  string `json:"head_sha"`
+	StartSHA string `json:"start_sha"`
+}
+
+// gitlabDiff is one file of a merge request diff
+type gitlabDiff struct {
+	OldPath     string `json:"old_path"`
+	NewPath     string `json:"new_path"`
+	Diff        string `json:"diff"`
+	NewFile     bool   `json:"new_file"`
+	DeletedFile bool   `json:"deleted_file"`
+}
+
+// newGitLabProviderFromEnv creates a provider for the merge request of the current GitLab CI
+// pipeline, from INPUT_GITLAB_TOKEN and the predefined CI variables, and loads its details
+func newGitLabProviderFromEnv(ctx context.Context, httpClient *http.Client) (*GitLabProvider, error) {
+	token := os.Getenv("INPUT_GITLAB_TOKEN")
+	if token == "" {
+		return nil, configErrorf("missing required input INPUT_GITLAB_TOKEN")
+	}
+	projectID := os.Getenv("CI_PROJECT_ID")
+	iid, err := strconv.Atoi(os.Getenv("CI_MERGE_REQUEST_IID"))
+	if projectID == "" || err != nil {
+		return nil, configErrorf("CI_PROJECT_ID and CI_MERGE_REQUEST_IID must be set, run the job in a merge request pipeline")
+	}
+	baseURL := os.Getenv("CI_API_V4_URL")
+	if baseURL == "" {
+		baseURL = gitlabAPIBaseURL
+	}
+
+	provider := &GitLabProvider{
+		Token:           token,
+		BaseURL:         strings.TrimSuffix(baseURL, "/"),
+		ProjectID:       projectID,
+		MergeRequestIID: iid,
+		HTTPClient:      httpClient,
+	}
+	if err := provider.loadMergeRequest(ctx); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// mergeRequestURL returns the API URL of the merge request, followed by path
+func (p *GitLabProvider) mergeRequestURL(path string) string {
+	return fmt.Sprintf("%s/projects/%s/merge_requests/%d%s", p.BaseURL, url.PathEscape(p.ProjectID), p.MergeRequestIID, path)
+}
+
+// loadMergeRequest fetches the title, description and diff refs of the merge request
+func (p *GitLabProvider) loadMergeRequest(ctx context.Context) error {
+	var mr struct {
+		Title       string         `json:"title"`
+		Description string         `json:"description"`
+		DiffRefs    gitlabDiffRefs `json:"diff_refs"`
+	}
+	if err := p.doJSON(ctx, "GET", p.mergeRequestURL(""), nil, http.StatusOK, &mr); err != nil {
+		return fmt.Errorf("failed to fetch merge request: %v", err)
+	}
+	p.Title = mr.Title
+	p.Description = mr.Description
+	p.diffRefs = mr.DiffRefs
+	return nil
+}
+
+// FetchDiff fetches the merge request diffs and joins them into a unified diff
+func (p *GitLabProvider) FetchDiff(ctx context.Context) (string, error) {
+	const perPage = 100
+	p.oldPaths = map[string]string{}
+	var sb strings.Builder
+	for page := 1; ; page++ {
+		var diffs []gitlabDiff
+		if err := p.doJSON(ctx, "GET", p.mergeRequestURL(fmt.Sprintf("/diffs?page=%d&per_page=%d", page, perPage)), nil, http.StatusOK, &diffs); err != nil {
+			return "", fmt.Errorf("failed to fetch merge request diffs: %v", err)
+		}
+		for _, diff := range diffs {
+			p.oldPaths[diff.NewPath] = diff.OldPath
+			writeGitLabDiff(&sb, diff)
+		}
+		if len(diffs) < perPage {
+			return sb.String(), nil
+		}
+	}
+}
+
+// writeGitLabDiff writes a file diff with the git headers GitLab leaves out
+func writeGitLabDiff(sb *strings.Builder, diff gitlabDiff) {
+	fmt.Fprintf(sb, "diff --git a/%s b/%s\n", diff.OldPath, diff.NewPath)
+	if diff.NewFile {
+		sb.WriteString("--- /dev/null\n")
+	} else {
+		fmt.Fprintf(sb, "--- a/%s\n", diff.OldPath)
+	}
+	if diff.DeletedFile {
+		sb.WriteString("+++ /dev/null\n")
+	} else {
+		fmt.Fprintf(sb, "+++ b/%s\n", diff.NewPath)
+	}
+	sb.WriteString(diff.Diff)
+	if diff.Diff != "" && !strings.HasSuffix(diff.Diff, "\n") {
+		sb.WriteString("\n")
+	}
+}
+
+// PostReview posts the body as a merge request note and each comment as a diff discussion.
+// A comment GitLab can't position on the diff is posted as a note mentioning its location.
+func (p *GitLabProvider) PostReview(ctx context.Context, body string, comments []Comment) error {
+	comments = addReviewMarker(comments)
+	if body != "" {
+		if err := p.postNote(ctx, body); err != nil {
+			return err
+		}
+	}
+
+	for _, comment := range comments {
+		oldPath := p.oldPaths[comment.Path]
+		if oldPath == "" {
+			oldPath = comment.Path
+		}
+		position := map[string]interface{}{
+			"position_type": "text",
+			"base_sha":      p.diffRefs.BaseSHA,
+			"head_sha":      p.diffRefs.HeadSHA,
+			"start_sha":     p.diffRefs.StartSHA,
+			"old_path":      oldPath,
+			"new_path":      comment.Path,
+		}
+		if comment.Side == SideLeft {
+			position["old_line"] = comment.Line
+		} else {
+			position["new_line"] = comment.Line
+		}
+
+		payload := map[string]interface{}{"body": comment.Body, "position": position}
+		err := p.doJSON(ctx, "POST", p.mergeRequestURL("/discussions"), payload, http.StatusCreated, nil)
+		if err == nil {
+			continue
+		}
+		fmt.Printf("Warning: could not comment on %s:%d, posting a note instead: %v\n", comment.Path, comment.Line, err)
+		if err := p.postNote(ctx, fmt.Sprintf("`%s:%d`\n\n%s", comment.Path, comment.Line, comment.Body)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postNote adds a general comment to the merge request
+func (p *GitLabProvider) postNote(ctx context.Context, body string) error {
+	if err := p.doJSON(ctx, "POST", p.mergeRequestURL("/notes"), map[string]string{"body": body}, http.StatusCreated, nil); err != nil {
+		return fmt.Errorf("failed to post merge request note: %v", err)
+	}
+	return nil
+}
+
+// doJSON sends an authenticated request with an optional JSON body and decodes the JSON response into out
+func (p *GitLabProvider) doJSON(ctx context.Context, method, url string, payload interface{}, wantStatus int, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewBuffer(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("PRIVATE-TOKEN", p.Token)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != wantStatus {
+		return fmt.Errorf("GitLab API returned %d: %s", resp.StatusCode, string(respBody))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeGitLab serves one merge request of project group/project and records the notes and
+// discussions posted to it. Discussions on removed.go are refused, like comments GitLab can't place.
+type fakeGitLab struct {
+	t           *testing.T
+	notes       []string
+	discussions []map[string]interface{}
+}
+
+func (f *fakeGitLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("PRIVATE-TOKEN") != "glpat" {
+		http.Error(w, `{"message":"401 Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	const mr = "/api/v4/projects/group%2Fproject/merge_requests/4"
+	switch r.Method + " " + r.URL.EscapedPath() {
+	case "GET " + mr:
+		w.Write([]byte(`{"title":"Add feature","description":"Details","diff_refs":{"base_sha":"b","head_sha":"h","start_sha":"s"}}`))
+	case "GET " + mr + "/diffs":
+		if r.URL.Query().Get("page") != "1" {
+			w.Write([]byte(`[]`))
+			return
+		}
+		json.NewEncoder(w).Encode([]gitlabDiff{
+			{OldPath: "old.go", NewPath: "renamed.go", Diff: "@@ -1,2 +1,2 @@\n package main\n-var a = 1\n+var a = 2"},
+			{OldPath: "new.go", NewPath: "new.go", NewFile: true, Diff: "@@ -0,0 +1 @@\n+package main\n"},
+		})
+	case "POST " + mr + "/notes":
+		var payload struct{ Body string }
+		json.NewDecoder(r.Body).Decode(&payload)
+		f.notes = append(f.notes, payload.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	case "POST " + mr + "/discussions":
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		position := payload["position"].(map[string]interface{})
+		if position["new_path"] == "removed.go" {
+			http.Error(w, `{"message":"400 Bad request - Note {:line_code=>[\"can't be blank\"]}"}`, http.StatusBadRequest)
+			return
+		}
+		f.discussions = append(f.discussions, payload)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{}`))
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}
+}
+
+func newTestGitLabProvider(t *testing.T) (*GitLabProvider, *fakeGitLab) {
+	t.Helper()
+	fake := &fakeGitLab{t: t}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	t.Setenv("INPUT_GITLAB_TOKEN", "glpat")
+	t.Setenv("CI_PROJECT_ID", "group/project")
+	t.Setenv("CI_MERGE_REQUEST_IID", "4")
+	t.Setenv("CI_API_V4_URL", srv.URL+"/api/v4/")
+	provider, err := newGitLabProviderFromEnv(context.Background(), srv.Client())
+	if err != nil {
+		t.Fatalf("newGitLabProviderFromEnv: %v", err)
+	}
+	return provider, fake
+}
+
+func TestGitLabFetchDiff(t *testing.T) {
+	provider, _ := newTestGitLabProvider(t)
+	if provider.Title != "Add feature" || provider.Description != "Details" {
+		t.Errorf("Title, Description = %q, %q", provider.Title, provider.Description)
+	}
+
+	diff, err := provider.FetchDiff(context.Background())
+	if err != nil {
+		t.Fatalf("FetchDiff: %v", err)
+	}
+	files, err := parseDiff(diff)
+	if err != nil {
+		t.Fatalf("parseDiff: %v\n%s", err, diff)
+	}
+	if len(files) != 2 || files[0].Path != "renamed.go" || files[1].Path != "new.go" || !files[1].Added {
+		t.Fatalf("files = %+v", files)
+	}
+	if got := files[0].Hunks[0].NewLineNumbers; len(got) != 3 || got[2] != 2 {
+		t.Errorf("NewLineNumbers = %v, want the added line on 2", got)
+	}
+	if provider.oldPaths["renamed.go"] != "old.go" {
+		t.Errorf("oldPaths = %v, want renamed.go from old.go", provider.oldPaths)
+	}
+}
+
+func TestGitLabPostReview(t *testing.T) {
+	provider, fake := newTestGitLabProvider(t)
+	if _, err := provider.FetchDiff(context.Background()); err != nil {
+		t.Fatalf("FetchDiff: %v", err)
+	}
+
+	comments := []Comment{
+		{Path: "renamed.go", Line: 2, Side: SideRight, Body: "**Info:** added"},
+		{Path: "renamed.go", Line: 2, Side: SideLeft, Body: "**Info:** removed"},
+		{Path: "removed.go", Line: 1, Side: SideRight, Body: "**Info:** unplaceable"},
+	}
+	if err := provider.PostReview(context.Background(), "Summary", comments); err != nil {
+		t.Fatalf("PostReview: %v", err)
+	}
+
+	if len(fake.discussions) != 2 {
+		t.Fatalf("posted %d discussions, want 2", len(fake.discussions))
+	}
+	right := fake.discussions[0]["position"].(map[string]interface{})
+	if right["old_path"] != "old.go" || right["new_path"] != "renamed.go" || right["new_line"] != float64(2) ||
+		right["base_sha"] != "b" || right["head_sha"] != "h" || right["start_sha"] != "s" {
+		t.Errorf("position = %v", right)
+	}
+	if left := fake.discussions[1]["position"].(map[string]interface{}); left["old_line"] != float64(2) || left["new_line"] != nil {
+		t.Errorf("position on the removed line = %v", left)
+	}
+	if body := fake.discussions[0]["body"].(string); !strings.HasPrefix(body, "**Info:** added") || !hasReviewMarker(body) {
+		t.Errorf("discussion body = %q, want the comment with its marker", body)
+	}
+
+	if len(fake.notes) != 2 || fake.notes[0] != "Summary" || !strings.HasPrefix(fake.notes[1], "`removed.go:1`\n\n**Info:** unplaceable") {
+		t.Errorf("notes = %q, want the summary and the unplaceable comment", fake.notes)
+	}
+}
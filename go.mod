@@ -5,9 +5,11 @@ go 1.21
 require (
 	github.com/google/go-github/v50 v50.2.0
 	golang.org/x/oauth2 v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	cloud.google.com/go/compute/metadata v0.3.0 // indirect
 	github.com/ProtonMail/go-crypto v0.0.0-20230217124315-7d5c6f04bbb8 // indirect
 	github.com/cloudflare/circl v1.1.0 // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
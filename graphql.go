@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// pullRequestSnapshot is what the review reads about a pull request, fetched in one GraphQL query
+// instead of a REST call for the PR, one per page of reviews and one per page of review comments.
+// The diff itself still comes from REST: GraphQL doesn't expose file patches.
+type pullRequestSnapshot struct {
+	Owner, Repo    string
+	Number         int
+	Info           pullRequestInfo
+	Reviews        []pullReview
+	ReviewComments []reviewComment
+}
+
+// The query reads up to 100 reviews and 100 threads of 100 comments, larger PRs fall back to REST
+const pullRequestSnapshotQuery = `query($owner: String!, $repo: String!, $number: Int!) {
+  repository(owner: $owner, name: $repo) {
+    pullRequest(number: $number) {
+      title
+      body
+      isDraft
+      author { __typename login }
+      headRefOid
+      baseRefOid
+      headRepository { nameWithOwner }
+      reviews(first: 100) {
+        pageInfo { hasNextPage }
+        nodes { databaseId body }
+      }
+      reviewThreads(first: 100) {
+        pageInfo { hasNextPage }
+        nodes {
+          isResolved
+          comments(first: 100) {
+            pageInfo { hasNextPage }
+            nodes { databaseId id path line diffSide body }
+          }
+        }
+      }
+    }
+  }
+}`
+
+type graphQLPageInfo struct {
+	HasNextPage bool `json:"hasNextPage"`
+}
+
+// fetchPullRequestSnapshot reads the PR details, reviews and review comments in a single query.
+// It returns nil without error when the PR has more than a query's worth of reviews or comments.
+func (c *GitHubClient) fetchPullRequestSnapshot(ctx context.Context, owner, repo string, pullNumber int) (*pullRequestSnapshot, error) {
+	payload := map[string]interface{}{
+		"query": pullRequestSnapshotQuery,
+		"variables": map[string]interface{}{
+			"owner":  owner,
+			"repo":   repo,
+			"number": pullNumber,
+		},
+	}
+	var result struct {
+		Data struct {
+			Repository struct {
+				PullRequest *struct {
+					Title   string `json:"title"`
+					Body    string `json:"body"`
+					IsDraft bool   `json:"isDraft"`
+					Author  *struct {
+						Typename string `json:"__typename"`
+						Login    string `json:"login"`
+					} `json:"author"`
+					HeadRefOid     string `json:"headRefOid"`
+					BaseRefOid     string `json:"baseRefOid"`
+					HeadRepository *struct {
+						NameWithOwner string `json:"nameWithOwner"`
+					} `json:"headRepository"`
+					Reviews struct {
+						PageInfo graphQLPageInfo `json:"pageInfo"`
+						Nodes    []struct {
+							DatabaseID int64  `json:"databaseId"`
+							Body       string `json:"body"`
+						} `json:"nodes"`
+					} `json:"reviews"`
+					ReviewThreads struct {
+						PageInfo graphQLPageInfo `json:"pageInfo"`
+						Nodes    []struct {
+							IsResolved bool `json:"isResolved"`
+							Comments   struct {
+								PageInfo graphQLPageInfo `json:"pageInfo"`
+								Nodes    []struct {
+									DatabaseID int64  `json:"databaseId"`
+									ID         string `json:"id"`
+									Path       string `json:"path"`
+									Line       *int   `json:"line"`
+									DiffSide   string `json:"diffSide"`
+									Body       string `json:"body"`
+								} `json:"nodes"`
+							} `json:"comments"`
+						} `json:"nodes"`
+					} `json:"reviewThreads"`
+				} `json:"pullRequest"`
+			} `json:"repository"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := c.doJSON(ctx, "POST", c.BaseURL+"/graphql", payload, http.StatusOK, &result); err != nil {
+		return nil, fmt.Errorf("failed to query pull request: %v", err)
+	}
+	if len(result.Errors) > 0 {
+		return nil, fmt.Errorf("failed to query pull request: %s", result.Errors[0].Message)
+	}
+	pr := result.Data.Repository.PullRequest
+	if pr == nil {
+		return nil, fmt.Errorf("failed to query pull request: #%d not found in %s/%s", pullNumber, owner, repo)
+	}
+	if pr.Reviews.PageInfo.HasNextPage || pr.ReviewThreads.PageInfo.HasNextPage {
+		return nil, nil
+	}
+
+	snapshot := &pullRequestSnapshot{Owner: owner, Repo: repo, Number: pullNumber}
+	snapshot.Info.Title = pr.Title
+	snapshot.Info.Body = pr.Body
+	snapshot.Info.Draft = pr.IsDraft
+	if pr.Author != nil {
+		// REST logins of apps carry a [bot] suffix, as INPUT_SKIP_AUTHORS expects
+		snapshot.Info.User.Login = pr.Author.Login
+		if pr.Author.Typename == "Bot" {
+			snapshot.Info.User.Login += "[bot]"
+		}
+	}
+	snapshot.Info.Head.SHA = pr.HeadRefOid
+	snapshot.Info.Base.SHA = pr.BaseRefOid
+	if pr.HeadRepository != nil {
+		snapshot.Info.Head.Repo.FullName = pr.HeadRepository.NameWithOwner
+	}
+	for _, review := range pr.Reviews.Nodes {
+		snapshot.Reviews = append(snapshot.Reviews, pullReview{ID: review.DatabaseID, Body: review.Body})
+	}
+	for _, thread := range pr.ReviewThreads.Nodes {
+		if thread.Comments.PageInfo.HasNextPage {
+			return nil, nil
+		}
+		var threadID int64
+		for i, comment := range thread.Comments.Nodes {
+			review := reviewComment{
+				ID:       comment.DatabaseID,
+				NodeID:   comment.ID,
+				Path:     comment.Path,
+				Line:     comment.Line,
+				Side:     comment.DiffSide,
+				Body:     comment.Body,
+				Resolved: thread.IsResolved,
+			}
+			// Replies point at the comment that started the thread, as in the REST API
+			if i == 0 {
+				threadID = comment.DatabaseID
+			} else {
+				review.InReplyToID = threadID
+			}
+			snapshot.ReviewComments = append(snapshot.ReviewComments, review)
+		}
+	}
+	return snapshot, nil
+}
+
+// snapshotFor returns the client's snapshot when it describes the given pull request
+func (c *GitHubClient) snapshotFor(owner, repo string, pullNumber int) *pullRequestSnapshot {
+	if s := c.Snapshot; s != nil && s.Owner == owner && s.Repo == repo && s.Number == pullNumber {
+		return s
+	}
+	return nil
+}
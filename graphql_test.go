@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const snapshotResponse = `{"data":{"repository":{"pullRequest":{
+  "title": "Add feature",
+  "body": "Details",
+  "isDraft": true,
+  "author": {"__typename": "Bot", "login": "renovate"},
+  "headRefOid": "head",
+  "baseRefOid": "base",
+  "headRepository": {"nameWithOwner": "fork/r"},
+  "reviews": {"pageInfo": {"hasNextPage": false}, "nodes": [{"databaseId": 10, "body": "LGTM"}]},
+  "reviewThreads": {"pageInfo": {"hasNextPage": %s}, "nodes": [
+    {"isResolved": true, "comments": {"pageInfo": {"hasNextPage": false}, "nodes": [
+      {"databaseId": 20, "id": "C_20", "path": "a.go", "line": 3, "diffSide": "RIGHT", "body": "first"},
+      {"databaseId": 21, "id": "C_21", "path": "a.go", "line": 3, "diffSide": "RIGHT", "body": "reply"}
+    ]}},
+    {"isResolved": false, "comments": {"pageInfo": {"hasNextPage": false}, "nodes": [
+      {"databaseId": 30, "id": "C_30", "path": "b.go", "line": null, "diffSide": "LEFT", "body": "outdated"}
+    ]}}
+  ]}
+}}}}`
+
+// newFakeGraphQL serves the snapshot query with response and fails the test on any other request
+func newFakeGraphQL(t *testing.T, response string) (*GitHubClient, *int) {
+	t.Helper()
+	queries := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/graphql" {
+			t.Errorf("unexpected REST request %s %s", r.Method, r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		queries++
+		var payload struct {
+			Query     string                 `json:"query"`
+			Variables map[string]interface{} `json:"variables"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding the query: %v", err)
+		}
+		want := map[string]interface{}{"owner": "o", "repo": "r", "number": float64(1)}
+		if payload.Query != pullRequestSnapshotQuery || !reflect.DeepEqual(payload.Variables, want) {
+			t.Errorf("query variables = %v, want %v", payload.Variables, want)
+		}
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(srv.Close)
+
+	client := NewGitHubClient("token", srv.Client())
+	client.BaseURL = srv.URL
+	return client, &queries
+}
+
+func TestFetchPullRequestSnapshot(t *testing.T) {
+	client, queries := newFakeGraphQL(t, fmt.Sprintf(snapshotResponse, "false"))
+	ctx := context.Background()
+	snapshot, err := client.fetchPullRequestSnapshot(ctx, "o", "r", 1)
+	if err != nil {
+		t.Fatalf("fetchPullRequestSnapshot: %v", err)
+	}
+	client.Snapshot = snapshot
+
+	// The REST reads are answered from the snapshot, the fake server refuses them
+	pr, err := client.getPullRequest(ctx, "o", "r", 1)
+	if err != nil {
+		t.Fatalf("getPullRequest: %v", err)
+	}
+	if pr.Title != "Add feature" || pr.Body != "Details" || !pr.Draft || pr.User.Login != "renovate[bot]" ||
+		pr.Head.SHA != "head" || pr.Base.SHA != "base" || pr.Head.Repo.FullName != "fork/r" {
+		t.Errorf("pull request = %+v", pr)
+	}
+	reviews, err := client.listReviews(ctx, "o", "r", 1)
+	if err != nil || !reflect.DeepEqual(reviews, []pullReview{{ID: 10, Body: "LGTM"}}) {
+		t.Errorf("listReviews() = %+v, %v", reviews, err)
+	}
+	comments, err := client.listReviewComments(ctx, "o", "r", 1)
+	if err != nil {
+		t.Fatalf("listReviewComments: %v", err)
+	}
+	line := 3
+	want := []reviewComment{
+		{ID: 20, NodeID: "C_20", Path: "a.go", Line: &line, Side: SideRight, Body: "first", Resolved: true},
+		{ID: 21, NodeID: "C_21", Path: "a.go", Line: &line, Side: SideRight, Body: "reply", InReplyToID: 20, Resolved: true},
+		{ID: 30, NodeID: "C_30", Path: "b.go", Side: SideLeft, Body: "outdated"},
+	}
+	if !reflect.DeepEqual(comments, want) {
+		t.Errorf("listReviewComments() = %+v, want %+v", comments, want)
+	}
+	if *queries != 1 {
+		t.Errorf("sent %d queries, want 1", *queries)
+	}
+}
+
+func TestFetchPullRequestSnapshotFallsBack(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		wantErr  string
+	}{
+		{"more threads than a query reads", fmt.Sprintf(snapshotResponse, "true"), ""},
+		{"query error", `{"errors":[{"message":"Resource not accessible by integration"}]}`, "Resource not accessible by integration"},
+		{"pull request not found", `{"data":{"repository":{"pullRequest":null}}}`, "#1 not found in o/r"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newFakeGraphQL(t, tt.response)
+			snapshot, err := client.fetchPullRequestSnapshot(context.Background(), "o", "r", 1)
+			if snapshot != nil {
+				t.Errorf("snapshot = %+v, want nil so REST is used", snapshot)
+			}
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
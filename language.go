@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// LanguageGuide is the review guidance injected into prompts for files of a language
+type LanguageGuide struct {
+	Language     string
+	Instructions string
+}
+
+// languageGuides maps lowercase file extensions (or base names for files without one)
+// to their guidance. Add an entry here to support another language; users can add or
+// override entries with INPUT_LANGUAGE_INSTRUCTIONS.
+var languageGuides = map[string]LanguageGuide{
+	".go":        {"Go", "Pay attention to goroutine leaks, unchecked errors, data races and missing context cancellation."},
+	".py":        {"Python", "Pay attention to mutable default arguments, broad exception handling and blocking calls in async code."},
+	".js":        {"JavaScript", "Pay attention to unhandled promise rejections, loose equality and XSS through unescaped HTML."},
+	".jsx":       {"JavaScript", "Pay attention to unhandled promise rejections, missing hook dependencies and XSS through unescaped HTML."},
+	".ts":        {"TypeScript", "Pay attention to unsafe any casts, unhandled promise rejections and non-null assertions hiding bugs."},
+	".tsx":       {"TypeScript", "Pay attention to unsafe any casts, missing hook dependencies and XSS through unescaped HTML."},
+	".java":      {"Java", "Pay attention to null handling, resource leaks without try-with-resources and thread safety."},
+	".rs":        {"Rust", "Pay attention to unnecessary unwrap/expect, unsafe blocks and needless clones."},
+	".sql":       {"SQL", "Pay attention to SQL injection, missing indexes for new queries and destructive migrations without safeguards."},
+	".tf":        {"Terraform", "Pay attention to overly permissive IAM and security groups, hardcoded secrets and resources that force replacement."},
+	".yaml":      {"YAML", "Pay attention to indentation mistakes, hardcoded secrets and, in CI or Kubernetes manifests, overly broad permissions."},
+	".yml":       {"YAML", "Pay attention to indentation mistakes, hardcoded secrets and, in CI or Kubernetes manifests, overly broad permissions."},
+	".sh":        {"Shell", "Pay attention to unquoted variables, missing error handling (set -euo pipefail) and command injection."},
+	"dockerfile": {"Dockerfile", "Pay attention to running as root, unpinned base images, secrets in layers and cache-busting layer order."},
+}
+
+// languageForPath returns the guidance for a file, or false when its language is unknown
+func languageForPath(path string, overrides map[string]LanguageGuide) (LanguageGuide, bool) {
+	key := strings.ToLower(filepath.Ext(path))
+	if key == "" {
+		key = strings.ToLower(filepath.Base(path))
+	}
+	if guide, ok := overrides[key]; ok {
+		return guide, true
+	}
+	guide, ok := languageGuides[key]
+	return guide, ok
+}
+
+// parseLanguageInstructions reads overrides written one per line as ".ext: instructions".
+// The extension is also used as the language name.
+func parseLanguageInstructions(value string) map[string]LanguageGuide {
+	overrides := map[string]LanguageGuide{}
+	for _, line := range strings.Split(value, "\n") {
+		key, instructions, ok := strings.Cut(line, ":")
+		key = strings.ToLower(strings.TrimSpace(key))
+		instructions = strings.TrimSpace(instructions)
+		if !ok || key == "" || instructions == "" {
+			continue
+		}
+		language := strings.TrimPrefix(key, ".")
+		if guide, ok := languageGuides[key]; ok {
+			language = guide.Language
+		}
+		overrides[key] = LanguageGuide{Language: language, Instructions: instructions}
+	}
+	return overrides
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Supported values of INPUT_DIFF_SOURCE
+const (
+	diffSourceGitHub = "github"
+	diffSourceStdin  = "stdin"
+)
+
+// reviewLocalDiff reviews a unified diff read from r (e.g. `git diff | action`) and prints
+// the findings to w, without any GitHub API calls or event payload
+func reviewLocalDiff(ctx context.Context, r io.Reader, w io.Writer, reviewer *Reviewer, maxHunkLines int) error {
+	diff, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read diff from stdin: %v", err)
+	}
+
+	parsedFiles, err := parseDiff(string(diff))
+	if err != nil {
+		return err
+	}
+
+	parsedFiles = filterReviewableFiles(parsedFiles)
+	if len(parsedFiles) == 0 {
+		fmt.Fprintln(w, "No reviewable changes found.")
+		return nil
+	}
+	parsedFiles = chunkLargeHunks(parsedFiles, maxHunkLines)
+
+	comments, err := reviewer.analyzeCodeUsingGemini(ctx, parsedFiles, "Local diff", "Changes read from stdin")
+	var failures FileErrors
+	var circuit *CircuitOpenError
+	if err != nil && !errors.As(err, &failures) && !errors.As(err, &circuit) {
+		return err
+	}
+
+	// Files are reviewed concurrently, sort so the output is stable
+	comments = filterValidComments(comments, parsedFiles)
+	sortComments(comments)
+	printComments(w, comments)
+	return err
+}
+
+// printComments writes findings in a "path:line (side)" format readable in a terminal
+func printComments(w io.Writer, comments []Comment) {
+	if len(comments) == 0 {
+		fmt.Fprintln(w, "Gemini found no issues.")
+		return
+	}
+	for _, comment := range comments {
+		fmt.Fprintf(w, "%s:%d (%s)\n%s\n\n", comment.Path, comment.Line, comment.Side, comment.Body)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestReviewLocalDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		diff     string
+		gemini   fakeModel
+		want     string
+		wantFail []string
+	}{
+		{
+			name:   "findings",
+			diff:   sampleDiff,
+			gemini: fakeModel{text: `[{"severity":"warning","comment":"Handle the error","line":9}]`},
+			want: "main.go:9 (RIGHT)\n**Warning:** Handle the error\n\n" +
+				"main.go:21 (RIGHT)\n**Warning:** Handle the error\n\n" +
+				"new.go:2 (RIGHT)\n**Warning:** Handle the error\n\n",
+		},
+		{
+			name:   "no findings",
+			diff:   sampleDiff,
+			gemini: fakeModel{text: "[]"},
+			want:   "Gemini found no issues.\n",
+		},
+		{
+			name:     "failed file reported after the others",
+			diff:     sampleDiff,
+			gemini:   fakeModel{text: `[{"severity":"info","comment":"Nit","line":9}]`, failOn: "File: new.go"},
+			want:     "main.go:9 (RIGHT)\n**Info:** Nit\n\nmain.go:21 (RIGHT)\n**Info:** Nit\n\n",
+			wantFail: []string{"new.go"},
+		},
+		{
+			name: "nothing reviewable",
+			diff: "diff --git a/old.go b/old.go\ndeleted file mode 100644\n--- a/old.go\n+++ /dev/null\n@@ -1 +0,0 @@\n-package main\n",
+			want: "No reviewable changes found.\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reviewer, _ := newTestReviewer(t, "pro", map[string]fakeModel{"pro": tt.gemini})
+
+			// Read the diff from a pipe, as `git diff | action` does
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				w.WriteString(tt.diff)
+				w.Close()
+			}()
+			defer r.Close()
+
+			var out bytes.Buffer
+			err = reviewLocalDiff(context.Background(), r, &out, reviewer, 0)
+			var failures FileErrors
+			errors.As(err, &failures)
+			if len(failures) != len(tt.wantFail) || err != nil && len(tt.wantFail) == 0 {
+				t.Fatalf("err = %v, want failures on %v", err, tt.wantFail)
+			}
+			for i, path := range tt.wantFail {
+				if failures[i].Path != path {
+					t.Errorf("failure %d on %s, want %s", i, failures[i].Path, path)
+				}
+			}
+			if out.String() != tt.want {
+				t.Errorf("output =\n%s\nwant\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -1,29 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
-type Comment struct {
-	Path     string `json:"path"`
-	Position int    `json:"position"`
-	Body     string `json:"body"`
-}
-
-type Hunk struct {
-	Header  string
-	Content string
-	Lines   []string
-}
+const (
+	defaultTimeoutSeconds = 300
+	// Hunks longer than this are split into several Gemini requests
+	defaultMaxHunkLines = 500
+	// Cached Gemini responses older than this are ignored
+	defaultCacheTTLHours = 7 * 24
+	// Prompts estimated at this many tokens or more are streamed
+	defaultStreamMinTokens = 8000
+	// Consecutive files Gemini may fail on before the review is stopped
+	defaultMaxConsecutiveFailures = 3
+	// Per-request timeout of the GitHub, GitLab and Bitbucket API calls
+	defaultHTTPTimeoutSeconds = 60
+	// Time allowed to post partial results once the run timeout has expired
+	partialPostTimeout = 30 * time.Second
+)
 
-type ParsedFile struct {
-	Path  string
-	Hunks []Hunk
-}
+// PR actions reviewed when INPUT_REVIEW_ON_ACTIONS is not set
+var defaultReviewOnActions = []string{"opened", "synchronize", "reopened"}
 
 // PRDetails struct to hold pull request details
 type PRDetails struct {
@@ -32,28 +39,24 @@ type PRDetails struct {
 	PullNumber  int
 	Title       string
 	Description string
+	HeadSHA     string
+	BaseSHA     string
+	// Repository the head branch lives in, which differs from Owner/Repo for PRs from forks.
+	// Reviews are always posted to the base repository.
+	HeadOwner string
+	HeadRepo  string
 }
 
-// GetPRDetails retrieves details of the pull request from GitHub Actions event payload
-func GetPRDetails() (*PRDetails, error) {
-	// Get the path to the GitHub event file
-	eventPath := os.Getenv("GITHUB_EVENT_PATH")
-	if eventPath == "" {
-		return nil, errors.New("GITHUB_EVENT_PATH environment variable is not set")
-	}
-
-	// Open and read the event file
-	file, err := os.Open(eventPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open event file: %v", err)
-	}
-	defer file.Close()
+// IsFork reports whether the PR comes from another repository than the one it targets
+func (d *PRDetails) IsFork() bool {
+	return !strings.EqualFold(d.HeadOwner+"/"+d.HeadRepo, d.Owner+"/"+d.Repo)
+}
 
-	var eventData map[string]interface{}
-	if err := json.NewDecoder(file).Decode(&eventData); err != nil {
-		return nil, fmt.Errorf("failed to decode JSON from event file: %v", err)
-	}
+// errNotPullRequest is returned for comments on plain issues, which the action ignores
+var errNotPullRequest = errors.New("the issue is not a pull request")
 
+// GetPRDetails retrieves details of the pull request from the GitHub Actions event payload
+func GetPRDetails(eventData map[string]interface{}) (*PRDetails, error) {
 	// Determine if the event was triggered by a comment on a PR or a direct PR event
 	var pullNumber int
 	var repoFullName string
@@ -61,19 +64,19 @@ func GetPRDetails() (*PRDetails, error) {
 	if issue, ok := eventData["issue"].(map[string]interface{}); ok {
 		if prData, exists := issue["pull_request"].(map[string]interface{}); exists && prData != nil {
 			// For comment triggers
-			if number, ok := issue["number"].(float64); ok {
-				pullNumber = int(number)
+			if number, ok := parsePullNumber(issue["number"]); ok {
+				pullNumber = number
 			} else {
 				return nil, errors.New("invalid pull request number in issue payload")
 			}
 		} else {
-			return nil, errors.New("issue payload does not contain pull_request data")
+			return nil, errNotPullRequest
 		}
 		repoFullName = getRepoFullName(eventData)
 	} else {
 		// For direct PR events
-		if number, ok := eventData["number"].(float64); ok {
-			pullNumber = int(number)
+		if number, ok := parsePullNumber(eventData["number"]); ok {
+			pullNumber = number
 		} else {
 			return nil, errors.New("invalid pull request number in event payload")
 		}
@@ -90,6 +93,15 @@ func GetPRDetails() (*PRDetails, error) {
 	}
 
 	title, description := getPRTitleAndDescription(eventData)
+	headSHA, baseSHA := getPRHeadAndBaseSHA(eventData)
+
+	// The head repository defaults to the base one, e.g. for comment triggers
+	headOwner, headRepo := owner, repo
+	if headFullName := getPRHeadRepoFullName(eventData); headFullName != "" {
+		if headOwner, headRepo, err = splitRepoFullName(headFullName); err != nil {
+			return nil, err
+		}
+	}
 
 	return &PRDetails{
 		Owner:       owner,
@@ -97,9 +109,36 @@ func GetPRDetails() (*PRDetails, error) {
 		PullNumber:  pullNumber,
 		Title:       title,
 		Description: description,
+		HeadSHA:     headSHA,
+		BaseSHA:     baseSHA,
+		HeadOwner:   headOwner,
+		HeadRepo:    headRepo,
 	}, nil
 }
 
+// loadPRDetails reads the event payload from GITHUB_EVENT_PATH and extracts the PR details.
+// It returns the payload too, for the checks that need more of it.
+func loadPRDetails() (*PRDetails, map[string]interface{}, error) {
+	eventData, err := loadEventData()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load event data: %v", err)
+	}
+	prDetails, err := GetPRDetails(eventData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve PR details: %w", err)
+	}
+	return prDetails, eventData, nil
+}
+
+// Helper to read a PR number from a payload value, JSON numbers decode as float64
+func parsePullNumber(value interface{}) (int, bool) {
+	number, ok := value.(float64)
+	if !ok || number <= 0 || number != float64(int(number)) {
+		return 0, false
+	}
+	return int(number), true
+}
+
 // Helper to extract repo full name from event data
 func getRepoFullName(eventData map[string]interface{}) string {
 	if repoData, ok := eventData["repository"].(map[string]interface{}); ok {
@@ -135,260 +174,755 @@ func getPRTitleAndDescription(eventData map[string]interface{}) (string, string)
 	return "No Title", "No Description"
 }
 
+// Helper to extract the head and base commit SHAs of the PR. Both pull_request and
+// pull_request_target payloads carry them, comment triggers don't.
+func getPRHeadAndBaseSHA(eventData map[string]interface{}) (string, string) {
+	pullRequest, ok := eventData["pull_request"].(map[string]interface{})
+	if !ok {
+		return "", ""
+	}
+	sha := func(key string) string {
+		if ref, ok := pullRequest[key].(map[string]interface{}); ok {
+			if sha, ok := ref["sha"].(string); ok {
+				return sha
+			}
+		}
+		return ""
+	}
+	return sha("head"), sha("base")
+}
+
+// Helper to extract the full name of the repository holding the PR head branch. It is
+// missing from comment triggers and null when the fork has been deleted.
+func getPRHeadRepoFullName(eventData map[string]interface{}) string {
+	if pullRequest, ok := eventData["pull_request"].(map[string]interface{}); ok {
+		if head, ok := pullRequest["head"].(map[string]interface{}); ok {
+			if repo, ok := head["repo"].(map[string]interface{}); ok {
+				if fullName, ok := repo["full_name"].(string); ok {
+					return fullName
+				}
+			}
+		}
+	}
+	return ""
+}
+
 // Helper function to load event data from the GITHUB_EVENT_PATH
 func loadEventData() (map[string]interface{}, error) {
 	eventPath := os.Getenv("GITHUB_EVENT_PATH")
 	if eventPath == "" {
 		return nil, fmt.Errorf("GITHUB_EVENT_PATH environment variable is not set")
 	}
+	return readEventFile(eventPath)
+}
 
-	file, err := os.Open(eventPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open event file: %v", err)
+// Errors returned by readEventFile, wrapped with the file path
+var (
+	errEventFileMissing     = errors.New("event file does not exist")
+	errEventFilePermission  = errors.New("permission denied reading event file")
+	errEventFileEmpty       = errors.New("event file is empty")
+	errEventFileInvalidJSON = errors.New("event file is not a valid JSON object")
+)
+
+// readEventFile reads and decodes a webhook event payload, telling apart the ways it can be unusable
+func readEventFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, fmt.Errorf("%w: %s", errEventFileMissing, path)
+	case errors.Is(err, fs.ErrPermission):
+		return nil, fmt.Errorf("%w: %s", errEventFilePermission, path)
+	case err != nil:
+		return nil, fmt.Errorf("failed to read event file: %v", err)
 	}
-	defer file.Close()
 
-	var eventData map[string]interface{}
-	if err := json.NewDecoder(file).Decode(&eventData); err != nil {
-		return nil, fmt.Errorf("failed to decode JSON from event file: %v", err)
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, fmt.Errorf("%w: %s", errEventFileEmpty, path)
 	}
 
+	var eventData map[string]interface{}
+	if err := json.Unmarshal(data, &eventData); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errEventFileInvalidJSON, path, err)
+	}
+	if eventData == nil {
+		return nil, fmt.Errorf("%w: %s: payload is null", errEventFileInvalidJSON, path)
+	}
 	return eventData, nil
 }
 
+// Helper to extract the login of the PR author from event data
+func getPRAuthor(eventData map[string]interface{}) string {
+	if pullRequest, ok := eventData["pull_request"].(map[string]interface{}); ok {
+		if user, ok := pullRequest["user"].(map[string]interface{}); ok {
+			if login, ok := user["login"].(string); ok {
+				return login
+			}
+		}
+	}
+	return ""
+}
+
+// Helper to check whether the pull request in the event data is a draft
+func isDraftPR(eventData map[string]interface{}) bool {
+	if pullRequest, ok := eventData["pull_request"].(map[string]interface{}); ok {
+		if draft, ok := pullRequest["draft"].(bool); ok {
+			return draft
+		}
+	}
+	return false
+}
+
+// Helper to extract the label names of the PR. Comment triggers carry them on the issue instead.
+func getPRLabels(eventData map[string]interface{}) []string {
+	var labelsData []interface{}
+	if pullRequest, ok := eventData["pull_request"].(map[string]interface{}); ok {
+		labelsData, _ = pullRequest["labels"].([]interface{})
+	} else if issue, ok := eventData["issue"].(map[string]interface{}); ok {
+		labelsData, _ = issue["labels"].([]interface{})
+	}
+
+	var labels []string
+	for _, labelData := range labelsData {
+		if label, ok := labelData.(map[string]interface{}); ok {
+			if name, ok := label["name"].(string); ok {
+				labels = append(labels, name)
+			}
+		}
+	}
+	return labels
+}
+
+// Helper to decide whether labels block the review. It returns a reason when any skip label
+// is present, or when required labels are configured and none of them is present.
+func checkLabels(labels, skipLabels, requireLabels []string) string {
+	for _, label := range labels {
+		if containsFold(skipLabels, label) {
+			return fmt.Sprintf("the PR has the skip label %q", label)
+		}
+	}
+	if len(requireLabels) == 0 {
+		return ""
+	}
+	for _, label := range labels {
+		if containsFold(requireLabels, label) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("the PR has none of the required labels %s", strings.Join(requireLabels, ", "))
+}
+
+// Helper to check whether values contains s, ignoring case
+func containsFold(values []string, s string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper to decide whether a pull_request(_target) action should trigger a review.
+// Other events, such as comment triggers, are not filtered by action.
+func shouldReviewAction(eventName, action string, allowedActions []string) bool {
+	if eventName != eventPullRequest && eventName != eventPullRequestTarget {
+		return true
+	}
+	return containsFold(allowedActions, action)
+}
+
+// Helper to split a comma- or newline-separated input into trimmed, non-empty values
+func parseListInput(value string) []string {
+	var items []string
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Helper to check whether the PR author is in the list of authors to skip.
+// GitHub logins are case-insensitive, so the comparison is too.
+func shouldSkipAuthor(author string, skipAuthors []string) bool {
+	if author == "" {
+		return false
+	}
+	return containsFold(skipAuthors, author)
+}
+
+// Helper to read an integer input, returning def when the input is unset
+func getIntInput(name string, def int) (int, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %q is not an integer", name, value)
+	}
+	return n, nil
+}
+
+// Helper to read a decimal number input, returning def when the input is unset
+func getFloatInput(name string, def float64) (float64, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %q is not a number", name, value)
+	}
+	return f, nil
+}
+
+// Helper to read a credential input. When the input is empty, it is read from the file named by
+// the same input with a _FILE suffix, for runners that mount secrets as files.
+func getSecretInput(name string) (string, error) {
+	if value := os.Getenv(name); value != "" {
+		return value, nil
+	}
+	path := strings.TrimSpace(os.Getenv(name + "_FILE"))
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s_FILE: %v", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Helper to read a boolean input, returning def when the input is unset
+func getBoolInput(name string, def bool) (bool, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %q is not a boolean", name, value)
+	}
+	return b, nil
+}
+
+// Helper to read a severity input, returning "" when the input is unset
+func getSeverityInput(name string) (string, error) {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv(name)))
+	switch value {
+	case "", SeverityCritical, SeverityWarning, SeverityInfo:
+		return value, nil
+	default:
+		return "", fmt.Errorf("invalid value for %s: %q is not one of %s, %s or %s", name, value, SeverityCritical, SeverityWarning, SeverityInfo)
+	}
+}
+
 // Helper function to get the GITHUB_EVENT_NAME environment variable
 func getEventName() string {
 	return os.Getenv("GITHUB_EVENT_NAME")
 }
 
-//func getDiff(owner, repo string, pullNumber int, githubToken string) (string, error) {
-//	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/pulls/%d", owner, repo, pullNumber)
-//	req, _ := http.NewRequest("GET", url, nil)
-//	req.Header.Set("Authorization", "Bearer "+githubToken)
-//
-//	client := &http.Client{}
-//	resp, err := client.Do(req)
-//	if err != nil {
-//		return "", err
-//	}
-//	defer resp.Body.Close()
-//
-//	body, err := ioutil.ReadAll(resp.Body)
-//	if err != nil {
-//		return "", err
-//	}
-//
-//	return string(body), nil
-//}
-//
-//func parseDiff(diff string) ([]ParsedFile, error) {
-//	var files []ParsedFile
-//	var currentFile *ParsedFile
-//	var currentHunk *Hunk
-//
-//	lines := strings.Split(diff, "\n")
-//	for _, line := range lines {
-//		switch {
-//		case strings.HasPrefix(line, "diff --git"):
-//			if currentFile != nil {
-//				files = append(files, *currentFile)
-//			}
-//			currentFile = &ParsedFile{}
-//
-//		case strings.HasPrefix(line, "--- a/"):
-//			if currentFile != nil {
-//				currentFile.Path = strings.TrimPrefix(line, "--- a/")
-//			}
-//
-//		case strings.HasPrefix(line, "+++ b/"):
-//			if currentFile != nil {
-//				currentFile.Path = strings.TrimPrefix(line, "+++ b/")
-//			}
-//
-//		case strings.HasPrefix(line, "@@"):
-//			if currentFile != nil {
-//				if currentHunk != nil {
-//					currentFile.Hunks = append(currentFile.Hunks, *currentHunk)
-//				}
-//				currentHunk = &Hunk{Header: line}
-//			}
-//
-//		default:
-//			if currentHunk != nil {
-//				currentHunk.Lines = append(currentHunk.Lines, line)
-//				currentHunk.Content += line + "\n"
-//			}
-//		}
-//	}
-//	if currentFile != nil {
-//		files = append(files, *currentFile)
-//	}
-//	return files, nil
-//}
-//
-//func createPrompt(file ParsedFile, hunk Hunk, title, description string) string {
-//	return fmt.Sprintf(`
-//Your task is to review pull requests. Instructions:
-//- Provide comments and suggestions ONLY if there is something to improve.
-//- Focus on bugs, security issues, and performance problems.
-//- Avoid generic comments and highlight critical issues.
-//
-//File: %s
-//Pull Request Title: %s
-//Pull Request Description: %s
-//
-//Diff Context:
-//%s
-//`, file.Path, title, description, hunk.Content)
-//}
-//
-//func analyzeCodeUsingGemini(parsedFiles []ParsedFile, title, description, geminiApiKey string) ([]Comment, error) {
-//	modelName := os.Getenv("GEMINI_MODEL")
-//	if modelName == "" {
-//		modelName = "gemini-1.5-flash-002"
-//	}
-//
-//	ctx := context.Background()
-//	client, err := genai.NewClient(ctx, option.WithAPIKey(geminiApiKey))
-//	if err != nil {
-//		return nil, fmt.Errorf("failed to create Gemini client: %v", err)
-//	}
-//	defer client.Close()
-//
-//	model := client.GenerativeModel(modelName)
-//	var comments []Comment
-//
-//	for _, file := range parsedFiles {
-//		for _, hunk := range file.Hunks {
-//			prompt := createPrompt(file, hunk, title, description)
-//
-//			response, err := model.GenerateContent(ctx, genai.Text(prompt))
-//			if err != nil {
-//				return nil, fmt.Errorf("error analyzing code with Gemini: %v", err)
-//			}
-//
-//			for _, candidate := range response.Candidates {
-//				if candidate.Content != nil {
-//					var fullText string
-//					for _, part := range candidate.Content.Parts {
-//						switch p := part.(type) {
-//						case genai.Text:
-//							// Handle text content
-//							fullText += string(p)
-//						case genai.FunctionCall:
-//							// Handle function call
-//							fullText += fmt.Sprintf("[Function call: %s]", p.Name)
-//						case genai.ExecutableCode:
-//							// Handle executable code
-//							fullText += fmt.Sprintf("[Code: %s]", p.Code)
-//						case genai.CodeExecutionResult:
-//							// Handle code execution results
-//							fullText += fmt.Sprintf("[Execution result: Outcome=%s, Output=%s]", p.Outcome, p.Output)
-//						default:
-//							fmt.Printf("Unhandled part type: %T\n", part)
-//						}
-//					}
-//
-//					comments = append(comments, Comment{
-//						Path:     file.Path,
-//						Position: 0, // Adjust based on the hunk line
-//						Body:     fullText,
-//					})
-//				}
-//			}
-//		}
-//	}
-//	return comments, nil
-//}
-//
-//func postReviewComments(owner, repo string, pullNumber int, comments []Comment, githubToken string) error {
-//	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/pulls/%d/reviews", owner, repo, pullNumber)
-//	requestBody, _ := json.Marshal(map[string]interface{}{
-//		"body":     "Automated review by Gemini AI",
-//		"event":    "COMMENT",
-//		"comments": comments,
-//	})
-//
-//	// Log the URL and payload for debugging
-//	fmt.Printf("Request URL: %s\n", url)
-//	fmt.Printf("Request Body: %s\n", string(requestBody))
-//
-//	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
-//	req.Header.Set("Authorization", "Bearer "+githubToken)
-//	req.Header.Set("Content-Type", "application/json")
-//
-//	client := &http.Client{}
-//	resp, err := client.Do(req)
-//	if err != nil {
-//		return err
-//	}
-//	defer resp.Body.Close()
-//
-//	if resp.StatusCode != http.StatusCreated {
-//		body, _ := ioutil.ReadAll(resp.Body)
-//		return fmt.Errorf("failed to post comments: %s", string(body))
-//	}
-//
-//	return nil
-//}
+// The events the action knows how to review
+const (
+	eventPullRequest       = "pull_request"
+	eventPullRequestTarget = "pull_request_target"
+	eventIssueComment      = "issue_comment"
+)
 
-func main() {
-	githubToken := os.Getenv("INPUT_GITHUB_TOKEN")
-	geminiApiKey := os.Getenv("INPUT_GEMINI_API_KEY")
+// errUnsupportedEvent is returned for workflow events the action can't review, such as push
+var errUnsupportedEvent = errors.New("unsupported event")
 
-	if githubToken == "" || geminiApiKey == "" {
-		fmt.Println("Error: Missing required inputs INPUT_GITHUB_TOKEN or INPUT_GEMINI_API_KEY.")
-		return
+// Helper to check that the workflow was triggered by an event the action can review
+func checkEventName(eventName string) error {
+	switch eventName {
+	case "":
+		return configErrorf("GITHUB_EVENT_NAME is not set")
+	case eventPullRequest, eventPullRequestTarget, eventIssueComment:
+		return nil
+	default:
+		return fmt.Errorf("%w %q, run the action on %s, %s or %s", errUnsupportedEvent, eventName, eventPullRequest, eventPullRequestTarget, eventIssueComment)
+	}
+}
+
+// readReviewOptions reads the inputs shared by every provider
+func readReviewOptions(maxHunkLines int, partialResults bool, timeoutSeconds int) (reviewOptions, error) {
+	opts := reviewOptions{
+		MaxHunkLines:   maxHunkLines,
+		IncludePaths:   parseListInput(os.Getenv("INPUT_PATHS")),
+		ExcludePaths:   parseListInput(os.Getenv("INPUT_EXCLUDE")),
+		PartialResults: partialResults,
+		TimeoutSeconds: timeoutSeconds,
 	}
 
-	prDetails, err := GetPRDetails()
+	var err error
+	// Keep the estimated prompt size within INPUT_MAX_INPUT_TOKENS, if set
+	if opts.MaxInputTokens, err = getIntInput("INPUT_MAX_INPUT_TOKENS", 0); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	if opts.MaxCommentsPerFile, err = getIntInput("INPUT_MAX_COMMENTS_PER_FILE", 0); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	if opts.CommentOnSuccess, err = getBoolInput("INPUT_COMMENT_ON_SUCCESS", false); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	if opts.MetricsSummary, err = getBoolInput("INPUT_METRICS_SUMMARY", false); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	if opts.IncludeSummary, err = getBoolInput("INPUT_INCLUDE_SUMMARY", false); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	if opts.OnlyNewFiles, err = getBoolInput("INPUT_ONLY_NEW_FILES", false); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	if opts.Preflight, err = getBoolInput("INPUT_GEMINI_PREFLIGHT", true); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	if opts.MaxDiffBytes, err = getIntInput("INPUT_MAX_DIFF_BYTES", 0); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	opts.CommentPrefix = os.Getenv("INPUT_COMMENT_PREFIX")
+	opts.RootDir = normalizeRootDir(os.Getenv("INPUT_ROOT_DIR"))
+	skipTests, err := getBoolInput("INPUT_SKIP_TESTS", false)
 	if err != nil {
-		fmt.Printf("Error retrieving PR details: %v\n", err)
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	if skipTests {
+		opts.TestPatterns = append(append([]string(nil), defaultTestPatterns...), parseListInput(os.Getenv("INPUT_TEST_PATTERNS"))...)
+	}
+	opts.OnlyFile = strings.TrimSpace(os.Getenv("INPUT_ONLY_FILE"))
+	if opts.ReviewDescription, err = getBoolInput("INPUT_REVIEW_DESCRIPTION", false); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	opts.DescriptionChecklist = parseListInput(os.Getenv("INPUT_DESCRIPTION_CHECKLIST"))
+	if opts.InlineMinSeverity, err = getSeverityInput("INPUT_INLINE_MIN_SEVERITY"); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	if opts.MergeSameLine, err = getBoolInput("INPUT_MERGE_SAME_LINE", false); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	if opts.GroupBySeverity, err = getBoolInput("INPUT_GROUP_BY_SEVERITY", false); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	if opts.IgnoreWhitespace, err = getBoolInput("INPUT_IGNORE_WHITESPACE", false); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	if opts.ReportResolved, err = getBoolInput("INPUT_REPORT_RESOLVED", false); err != nil {
+		return opts, configErrorf("invalid inputs: %v", err)
+	}
+	return opts, nil
+}
+
+// Exit codes distinguish invalid inputs from failures during the review
+const (
+	exitRuntimeError = 1
+	exitConfigError  = 2
+)
+
+// configError marks errors caused by missing or invalid inputs
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string { return e.err.Error() }
+
+func (e *configError) Unwrap() error { return e.err }
+
+// configErrorf formats a configuration error
+func configErrorf(format string, args ...interface{}) error {
+	return &configError{fmt.Errorf(format, args...)}
+}
+
+func main() {
+	if len(os.Args) > 1 && (os.Args[1] == "--version" || os.Args[1] == "-version") {
+		fmt.Println(versionString())
 		return
 	}
+	if err := run(); err != nil {
+		fmt.Println("Error:", err)
+		var cfgErr *configError
+		if errors.As(err, &cfgErr) {
+			os.Exit(exitConfigError)
+		}
+		os.Exit(exitRuntimeError)
+	}
+}
 
-	fmt.Printf("PR Details: %+v\n", prDetails)
+// run performs the review. Skipped reviews return nil; errors caused by the inputs are *configError.
+func run() error {
+	fmt.Println(versionString())
+	printVersion, err := getBoolInput("INPUT_PRINT_VERSION", false)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+	if printVersion {
+		return nil
+	}
 
-	// Load the event data
-	eventData, err := loadEventData()
+	githubToken, err := getSecretInput("INPUT_GITHUB_TOKEN")
 	if err != nil {
-		fmt.Printf("Error loading event data: %v\n", err)
-		return
+		return configErrorf("invalid inputs: %v", err)
+	}
+	geminiApiKey, err := getSecretInput("INPUT_GEMINI_API_KEY")
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
 	}
 
-	// Get the event name
-	eventName := getEventName()
-	if eventName == "" {
-		fmt.Println("GITHUB_EVENT_NAME is not set")
-		return
+	// Bound the whole run so a hanging Gemini or GitHub call doesn't run until the job timeout
+	timeoutSeconds, err := getIntInput("INPUT_TIMEOUT_SECONDS", defaultTimeoutSeconds)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
 	}
+	if timeoutSeconds <= 0 {
+		return configErrorf("INPUT_TIMEOUT_SECONDS must be greater than 0")
+	}
+	partialResults, err := getBoolInput("INPUT_PARTIAL_RESULTS", false)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+	maxHunkLines, err := getIntInput("INPUT_MAX_HUNK_LINES", defaultMaxHunkLines)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	// Both the GitHub and Gemini clients honor the proxy settings
+	httpClient, err := newHTTPClient(os.Getenv("INPUT_PROXY_URL"))
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+	// Files are reviewed this many at a time, and Gemini and code host requests share the same
+	// limit on how many can be in flight at once
+	concurrency, err := getIntInput("INPUT_CONCURRENCY", 0)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+	httpClient.Transport = newLimitedTransport(httpClient.Transport, concurrency)
+	// A stalled code host connection fails the request instead of hanging the job
+	httpTimeoutSeconds, err := getIntInput("INPUT_HTTP_TIMEOUT_SECONDS", defaultHTTPTimeoutSeconds)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+	if httpTimeoutSeconds <= 0 {
+		return configErrorf("INPUT_HTTP_TIMEOUT_SECONDS must be greater than 0")
+	}
+	apiClient := withRequestTimeout(httpClient, time.Duration(httpTimeoutSeconds)*time.Second)
 
+	geminiClient, err := newGeminiClientFromInputs(ctx, httpClient, geminiApiKey)
+	if err != nil {
+		return configErrorf("failed to create Gemini client: %v", err)
+	}
+
+	models := resolveGeminiModels()
+	modelName := models[0]
+	fmt.Printf("Using Gemini model: %s\n", strings.Join(models, ", "))
+
+	// Validate the prompt template before doing any work
+	promptTemplate, err := parsePromptTemplate(os.Getenv("INPUT_PROMPT_TEMPLATE"))
+	if err != nil {
+		return &configError{err}
+	}
+
+	cacheTTLHours, err := getIntInput("INPUT_CACHE_TTL_HOURS", defaultCacheTTLHours)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+	cache, err := newReviewCache(os.Getenv("INPUT_CACHE_DIR"), time.Duration(cacheTTLHours)*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	reportBlocked, err := getBoolInput("INPUT_REPORT_BLOCKED", false)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+
+	streamMinTokens, err := getIntInput("INPUT_STREAM_MIN_TOKENS", defaultStreamMinTokens)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+
+	includeRationale, err := getBoolInput("INPUT_INCLUDE_RATIONALE", false)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+
+	maxConsecutiveFailures, err := getIntInput("INPUT_MAX_CONSECUTIVE_FAILURES", defaultMaxConsecutiveFailures)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+
+	reviewer := &Reviewer{
+		Client:        geminiClient,
+		Model:         modelName,
+		FallbackModel: normalizeModelName(os.Getenv("INPUT_GEMINI_MODEL_FALLBACK")),
+		Prompts: &PromptBuilder{
+			Template:           promptTemplate,
+			LanguageOverrides:  parseLanguageInstructions(os.Getenv("INPUT_LANGUAGE_INSTRUCTIONS")),
+			CustomInstructions: os.Getenv("INPUT_CUSTOM_INSTRUCTIONS"),
+			ReviewLanguage:     os.Getenv("INPUT_REVIEW_LANGUAGE"),
+			Env:                promptEnv(os.Environ()),
+			IncludeRationale:   includeRationale,
+		},
+		Metrics:                &metricsRecorder{},
+		Cache:                  cache,
+		ReportBlocked:          reportBlocked,
+		StreamMinTokens:        streamMinTokens,
+		MaxConsecutiveFailures: maxConsecutiveFailures,
+		Concurrency:            concurrency,
+		ExtraModels:            models[1:],
+	}
+
+	// Review a diff piped on stdin, skipping GitHub entirely
+	switch diffSource := strings.ToLower(strings.TrimSpace(os.Getenv("INPUT_DIFF_SOURCE"))); diffSource {
+	case "", diffSourceGitHub:
+	case diffSourceStdin:
+		if err := reviewLocalDiff(ctx, os.Stdin, os.Stdout, reviewer, maxHunkLines); err != nil {
+			return fmt.Errorf("failed to review local diff: %v", err)
+		}
+		return nil
+	default:
+		return configErrorf("unsupported INPUT_DIFF_SOURCE %q (expected %q or %q)", diffSource, diffSourceGitHub, diffSourceStdin)
+	}
+
+	opts, err := readReviewOptions(maxHunkLines, partialResults, timeoutSeconds)
+	if err != nil {
+		return err
+	}
+	reviewer.Prompts.RootDir = opts.RootDir
+
+	// Review GitLab merge requests and Bitbucket pull requests through the same pipeline
+	provider, err := parseProvider(os.Getenv("INPUT_PROVIDER"))
+	if err != nil {
+		return &configError{err}
+	}
+	switch provider {
+	case providerGitLab:
+		gitlab, err := newGitLabProviderFromEnv(ctx, apiClient)
+		if err != nil {
+			return err
+		}
+		return runReview(ctx, gitlab, reviewer, gitlab.Title, gitlab.Description, opts)
+	case providerBitbucket:
+		bitbucket, err := newBitbucketProviderFromEnv(ctx, apiClient)
+		if err != nil {
+			return err
+		}
+		return runReview(ctx, bitbucket, reviewer, bitbucket.Title, bitbucket.Description, opts)
+	}
+
+	// Check runs and statuses always report, so a clean review shows up as a success
+	outputMode, err := parseOutputMode(os.Getenv("INPUT_OUTPUT_MODE"))
+	if err != nil {
+		return &configError{err}
+	}
+	annotationLevels, err := parseAnnotationLevels(os.Getenv("INPUT_ANNOTATION_LEVELS"))
+	if err != nil {
+		return &configError{err}
+	}
+	// A check run or commit status is always set, a clean review concludes it successfully.
+	// Incomplete reviews get their own conclusion, see PostReviewWithConclusion.
+	if outputMode == outputModeChecks || outputMode == outputModeStatusOnly {
+		opts.CommentOnSuccess = true
+	}
+
+	// A GitHub App installation token takes precedence over INPUT_GITHUB_TOKEN when configured
+	appID := os.Getenv("INPUT_APP_ID")
+	appPrivateKey := os.Getenv("INPUT_APP_PRIVATE_KEY")
+	if (appID == "") != (appPrivateKey == "") {
+		return configErrorf("INPUT_APP_ID and INPUT_APP_PRIVATE_KEY must be set together")
+	}
+	// Callers can review an explicit commit range instead of the PR diff
+	baseSHA := strings.TrimSpace(os.Getenv("INPUT_BASE_SHA"))
+	headSHA := strings.TrimSpace(os.Getenv("INPUT_HEAD_SHA"))
+	if (baseSHA == "") != (headSHA == "") {
+		return configErrorf("INPUT_BASE_SHA and INPUT_HEAD_SHA must be set together")
+	}
+	// Or the PR head against another branch, e.g. main for PRs targeting a feature branch
+	compareBase := strings.TrimSpace(os.Getenv("INPUT_COMPARE_BASE"))
+	if compareBase != "" && baseSHA != "" {
+		return configErrorf("INPUT_COMPARE_BASE can't be combined with INPUT_BASE_SHA and INPUT_HEAD_SHA")
+	}
+	if githubToken == "" && appID == "" {
+		return configErrorf("missing required input INPUT_GITHUB_TOKEN")
+	}
+	githubClient := NewGitHubClient(githubToken, apiClient)
+
+	// Only check the credentials when running the self-test
+	selfTest, err := getBoolInput("INPUT_SELFTEST", false)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+	if selfTest {
+		return runSelfTest(ctx, os.Stdout, githubClient, appID, appPrivateKey, geminiClient, modelName)
+	}
+
+	eventName := getEventName()
+	if err := checkEventName(eventName); err != nil {
+		if errors.Is(err, errUnsupportedEvent) {
+			fmt.Printf("Skipping review: %v.\n", err)
+			return nil
+		}
+		return err
+	}
 	fmt.Printf("Event Name: %s\n", eventName)
-	fmt.Printf("Event Data: %+v\n", eventData)
-
-	//diff, err := getDiff(prDetails.Owner, prDetails.Repo, prDetails.PullNumber, githubToken)
-	//if err != nil {
-	//	fmt.Println("Error fetching diff:", err)
-	//	return
-	//}
-	//
-	//parsedFiles, err := parseDiff(diff)
-	//if err != nil {
-	//	fmt.Println("Error parsing diff:", err)
-	//	return
-	//}
-	//
-	//comments, err := analyzeCodeUsingGemini(parsedFiles, prDetails.Title, prDetails.Description, geminiApiKey)
-	//if err != nil {
-	//	fmt.Println("Error analyzing code:", err)
-	//	return
-	//}
-	//
-	//err = postReviewComments(prDetails.Owner, prDetails.Repo, prDetails.PullNumber, comments, githubToken)
-	//if err != nil {
-	//	fmt.Println("Error posting comments:", err)
-	//	return
-	//}
-	//
-	//fmt.Println("Review comments posted successfully.")
+
+	prDetails, eventData, err := loadPRDetails()
+	if errors.Is(err, errNotPullRequest) {
+		fmt.Println("Skipping review: the comment is on an issue, not a pull request.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("PR Details: %+v\n", prDetails)
+
+	if appID != "" {
+		if err := githubClient.useAppInstallationToken(ctx, appID, appPrivateKey, prDetails.Owner, prDetails.Repo); err != nil {
+			return fmt.Errorf("failed to authenticate as GitHub App: %v", err)
+		}
+		fmt.Println("Authenticated as GitHub App installation")
+	}
+
+	// Read the PR, its reviews and review comments in one GraphQL query instead of several REST calls
+	useGraphQL, err := getBoolInput("INPUT_USE_GRAPHQL", false)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+	if useGraphQL {
+		snapshot, err := githubClient.fetchPullRequestSnapshot(ctx, prDetails.Owner, prDetails.Repo, prDetails.PullNumber)
+		switch {
+		case err != nil:
+			fmt.Println("Warning:", err)
+		case snapshot == nil:
+			fmt.Println("The PR has too many reviews for a single GraphQL query, using the REST API")
+		default:
+			githubClient.Snapshot = snapshot
+		}
+	}
+
+	author := getPRAuthor(eventData)
+	draft := isDraftPR(eventData)
+	// Comment triggers don't include the pull request in the payload, fetch it for the review context
+	if eventName == eventIssueComment {
+		pr, err := githubClient.getPullRequest(ctx, prDetails.Owner, prDetails.Repo, prDetails.PullNumber)
+		if err != nil {
+			fmt.Printf("Warning: could not fetch the PR title and description: %v\n", err)
+		} else {
+			prDetails.Title = pr.Title
+			prDetails.Description = pr.Body
+			prDetails.HeadSHA = pr.Head.SHA
+			prDetails.BaseSHA = pr.Base.SHA
+			author, draft = pr.User.Login, pr.Draft
+			if owner, repo, err := splitRepoFullName(pr.Head.Repo.FullName); err == nil {
+				prDetails.HeadOwner, prDetails.HeadRepo = owner, repo
+			}
+		}
+	}
+
+	if prDetails.IsFork() {
+		fmt.Printf("PR from fork %s/%s, posting the review to %s/%s\n", prDetails.HeadOwner, prDetails.HeadRepo, prDetails.Owner, prDetails.Repo)
+	}
+
+	// Skip PRs opened by ignored authors such as dependency bots
+	if shouldSkipAuthor(author, parseListInput(os.Getenv("INPUT_SKIP_AUTHORS"))) {
+		fmt.Printf("Skipping review: PR author %s is listed in INPUT_SKIP_AUTHORS.\n", author)
+		return nil
+	}
+
+	// Draft PRs are only reviewed when explicitly enabled
+	reviewDrafts, err := getBoolInput("INPUT_REVIEW_DRAFTS", false)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+	if draft && !reviewDrafts {
+		fmt.Println("Skipping review: the PR is a draft. Set INPUT_REVIEW_DRAFTS=true to review drafts.")
+		return nil
+	}
+
+	// Skip or require reviews based on the PR labels
+	if reason := checkLabels(getPRLabels(eventData), parseListInput(os.Getenv("INPUT_SKIP_LABELS")), parseListInput(os.Getenv("INPUT_REQUIRE_LABELS"))); reason != "" {
+		fmt.Printf("Skipping review: %s.\n", reason)
+		return nil
+	}
+
+	// Only review for the configured PR actions, e.g. not when a PR is closed or its title edited
+	action, _ := eventData["action"].(string)
+	reviewOnActions := parseListInput(os.Getenv("INPUT_REVIEW_ON_ACTIONS"))
+	if len(reviewOnActions) == 0 {
+		reviewOnActions = defaultReviewOnActions
+	}
+	if !shouldReviewAction(eventName, action, reviewOnActions) {
+		fmt.Printf("Skipping review: action %q is not one of %s.\n", action, strings.Join(reviewOnActions, ", "))
+		return nil
+	}
+
+	autoApprove, err := getBoolInput("INPUT_AUTO_APPROVE", false)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+	minimizeOutdated, err := getBoolInput("INPUT_MINIMIZE_OUTDATED", true)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+	useFilesAPI, err := getBoolInput("INPUT_USE_FILES_API", false)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+	replyToThreads, err := getBoolInput("INPUT_REPLY_TO_THREADS", false)
+	if err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+
+	reviewEventMode := os.Getenv("INPUT_REVIEW_EVENT")
+	if _, err := determineReviewEvent(reviewEventMode, nil, autoApprove); err != nil {
+		return configErrorf("invalid inputs: %v", err)
+	}
+
+	// Settings committed in the repository apply unless the matching input is set
+	configInputs, err := readConfigInputs()
+	if err != nil {
+		return &configError{err}
+	}
+	repoConfig, err := loadRepoConfig(ctx, githubClient, prDetails, eventName)
+	if err != nil {
+		return &configError{err}
+	}
+	settings := mergeRepoConfig(repoConfig, configInputs)
+	opts.ExcludePaths = settings.Exclude
+	opts.MinSeverity = settings.MinSeverity
+	opts.MaxFiles = settings.MaxFiles
+	// An explicit list of models to merge leaves the config file model out
+	if settings.Model != "" && settings.Model != reviewer.Model && len(parseListInput(os.Getenv("INPUT_GEMINI_MODELS"))) == 0 {
+		reviewer.Model = normalizeModelName(settings.Model)
+		fmt.Printf("Using Gemini model from %s: %s\n", repoConfigPath, reviewer.Model)
+	}
+
+	// Unchanged files Gemini can read to understand the change, e.g. shared types or interfaces
+	if patterns := parseListInput(os.Getenv("INPUT_CONTEXT_FILES")); len(patterns) > 0 {
+		contextFiles, err := githubClient.loadContextFiles(ctx, prDetails.HeadOwner, prDetails.HeadRepo, prDetails.HeadSHA, patterns)
+		if err != nil {
+			return fmt.Errorf("failed to load context files: %v", err)
+		}
+		reviewer.Prompts.ContextFiles = contextFiles
+		fmt.Printf("Including %d context file(s)\n", len(contextFiles))
+	}
+
+	githubProvider := &GitHubProvider{
+		Client:           githubClient,
+		PR:               prDetails,
+		EventName:        eventName,
+		BaseSHA:          baseSHA,
+		HeadSHA:          headSHA,
+		CompareBase:      compareBase,
+		ReviewEventMode:  reviewEventMode,
+		AutoApprove:      autoApprove,
+		OutputMode:       outputMode,
+		AnnotationLevels: annotationLevels,
+		MinimizeComments: minimizeOutdated,
+		UseFilesAPI:      useFilesAPI,
+		ReplyToThreads:   replyToThreads,
+	}
+	return runReview(ctx, githubProvider, reviewer, prDetails.Title, prDetails.Description, opts)
 }
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseListInput(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"", nil},
+		{"a, b", []string{"a", "b"}},
+		{"a\n b\n\n,c,", []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		if got := parseListInput(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseListInput(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestGetSecretInput(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		value   string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"value", "from-env", file, "from-env", false},
+		{"file", "", file, "from-file", false},
+		{"unset", "", "", "", false},
+		{"missing file", "", filepath.Join(t.TempDir(), "missing"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("INPUT_TEST_SECRET", tt.value)
+			t.Setenv("INPUT_TEST_SECRET_FILE", tt.path)
+			got, err := getSecretInput("INPUT_TEST_SECRET")
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("getSecretInput() = %q, %v, want %q, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetPRAuthor(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventData map[string]interface{}
+		want      string
+	}{
+		{
+			name:      "pull request",
+			eventData: map[string]interface{}{"pull_request": map[string]interface{}{"user": map[string]interface{}{"login": "dependabot[bot]"}}},
+			want:      "dependabot[bot]",
+		},
+		{name: "comment event", eventData: map[string]interface{}{"issue": map[string]interface{}{"number": 1.0}}, want: ""},
+		{name: "no user", eventData: map[string]interface{}{"pull_request": map[string]interface{}{}}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getPRAuthor(tt.eventData); got != tt.want {
+				t.Errorf("getPRAuthor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldSkipAuthor(t *testing.T) {
+	tests := []struct {
+		author string
+		skip   []string
+		want   bool
+	}{
+		{"dependabot[bot]", []string{"Dependabot[bot]"}, true},
+		{"renovate[bot]", []string{"dependabot[bot]", "renovate[bot]"}, true},
+		{"alice", []string{"dependabot[bot]"}, false},
+		{"alice", nil, false},
+		{"", []string{""}, false},
+	}
+	for _, tt := range tests {
+		if got := shouldSkipAuthor(tt.author, tt.skip); got != tt.want {
+			t.Errorf("shouldSkipAuthor(%q, %q) = %v, want %v", tt.author, tt.skip, got, tt.want)
+		}
+	}
+}
+
+func TestReadEventFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr error
+	}{
+		{"valid", write("valid.json", `{"number": 1}`), nil},
+		{"missing", filepath.Join(dir, "missing.json"), errEventFileMissing},
+		{"empty", write("empty.json", " \n"), errEventFileEmpty},
+		{"partial", write("partial.json", `{"number": 1, "pull_request": {`), errEventFileInvalidJSON},
+		{"not an object", write("array.json", `[1, 2]`), errEventFileInvalidJSON},
+		{"null", write("null.json", `null`), errEventFileInvalidJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eventData, err := readEventFile(tt.path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && eventData["number"] != float64(1) {
+				t.Errorf("eventData = %v", eventData)
+			}
+		})
+	}
+}
+
+func TestReadEventFilePermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read files regardless of their mode")
+	}
+	path := filepath.Join(t.TempDir(), "event.json")
+	if err := os.WriteFile(path, []byte(`{}`), 0o000); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := readEventFile(path); !errors.Is(err, errEventFilePermission) {
+		t.Errorf("err = %v, want %v", err, errEventFilePermission)
+	}
+}
+
+func TestLoadEventData(t *testing.T) {
+	t.Setenv("GITHUB_EVENT_PATH", "")
+	if _, err := loadEventData(); err == nil {
+		t.Error("loadEventData() succeeded without GITHUB_EVENT_PATH")
+	}
+
+	path := filepath.Join(t.TempDir(), "event.json")
+	t.Setenv("GITHUB_EVENT_PATH", path)
+	if _, err := loadEventData(); !errors.Is(err, errEventFileMissing) {
+		t.Errorf("err = %v, want %v", err, errEventFileMissing)
+	}
+}
+
+func TestGetPRDetails(t *testing.T) {
+	repository := map[string]interface{}{"full_name": "octo/repo"}
+	tests := []struct {
+		name    string
+		event   map[string]interface{}
+		want    *PRDetails
+		wantErr string
+	}{
+		{
+			name: "pull request",
+			event: map[string]interface{}{
+				"number":     float64(7),
+				"repository": repository,
+				"pull_request": map[string]interface{}{
+					"title": "Fix it",
+					"body":  "Details",
+					"head":  map[string]interface{}{"sha": "h1", "repo": map[string]interface{}{"full_name": "fork/repo"}},
+					"base":  map[string]interface{}{"sha": "b1"},
+				},
+			},
+			want: &PRDetails{Owner: "octo", Repo: "repo", PullNumber: 7, Title: "Fix it", Description: "Details",
+				HeadSHA: "h1", BaseSHA: "b1", HeadOwner: "fork", HeadRepo: "repo"},
+		},
+		{
+			name: "comment on a pull request",
+			event: map[string]interface{}{
+				"issue":      map[string]interface{}{"number": float64(3), "pull_request": map[string]interface{}{"url": "x"}},
+				"repository": repository,
+			},
+			want: &PRDetails{Owner: "octo", Repo: "repo", PullNumber: 3, Title: "No Title", Description: "No Description",
+				HeadOwner: "octo", HeadRepo: "repo"},
+		},
+		{
+			name: "comment on an issue",
+			event: map[string]interface{}{
+				"issue":      map[string]interface{}{"number": float64(3)},
+				"repository": repository,
+			},
+			wantErr: errNotPullRequest.Error(),
+		},
+		{
+			name:    "missing number",
+			event:   map[string]interface{}{"repository": repository},
+			wantErr: "invalid pull request number in event payload",
+		},
+		{
+			name:    "number as a string",
+			event:   map[string]interface{}{"number": "7", "repository": repository},
+			wantErr: "invalid pull request number in event payload",
+		},
+		{
+			name:    "fractional number",
+			event:   map[string]interface{}{"number": 7.5, "repository": repository},
+			wantErr: "invalid pull request number in event payload",
+		},
+		{
+			name: "negative issue number",
+			event: map[string]interface{}{
+				"issue":      map[string]interface{}{"number": float64(-1), "pull_request": map[string]interface{}{}},
+				"repository": repository,
+			},
+			wantErr: "invalid pull request number in issue payload",
+		},
+		{
+			name:    "missing repository",
+			event:   map[string]interface{}{"number": float64(7)},
+			wantErr: "repository full name not found in event data",
+		},
+		{
+			name:    "malformed repository",
+			event:   map[string]interface{}{"number": float64(7), "repository": map[string]interface{}{"full_name": "octo"}},
+			wantErr: "invalid repository full name: octo",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetPRDetails(tt.event)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetPRDetails: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetPRDetails() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPRDetails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "event.json")
+	if err := os.WriteFile(path, []byte(`{"number": 7, "repository": {"full_name": "octo/repo"}}`), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	t.Setenv("GITHUB_EVENT_PATH", path)
+	prDetails, eventData, err := loadPRDetails()
+	if err != nil {
+		t.Fatalf("loadPRDetails: %v", err)
+	}
+	if prDetails.PullNumber != 7 || prDetails.Owner != "octo" || eventData["number"] != float64(7) {
+		t.Errorf("loadPRDetails() = %+v, %v", prDetails, eventData)
+	}
+}
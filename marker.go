@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Every comment the action posts ends with a hidden provenance marker,
+// <!-- gemini-review:path:line:hash -->, so later runs can find and deduplicate them.
+// Comments from older versions carry the bare legacyReviewMarker instead.
+const (
+	reviewMarkerPrefix = "<!-- gemini-review"
+	legacyReviewMarker = "<!-- gemini-review -->"
+)
+
+// The review body carries <!-- gemini-review-body:hash -->, a fingerprint of the body and every
+// comment of the review, so a re-run can tell that it would post the same review again
+const reviewBodyMarkerPrefix = "<!-- gemini-review-body:"
+
+var reviewBodyMarkerRegex = regexp.MustCompile(`<!-- gemini-review-body:([0-9a-f]+) -->`)
+
+// Paths may contain colons, so line and hash are matched from the end
+var provenanceMarkerRegex = regexp.MustCompile(`<!-- gemini-review:(.+):(\d+):([0-9a-f]+) -->`)
+
+// commentHash identifies a comment by its text, independent of where it is anchored
+func commentHash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// formatProvenanceMarker returns the hidden marker for a comment on path:line with the given hash
+func formatProvenanceMarker(path string, line int, hash string) string {
+	return fmt.Sprintf("<!-- gemini-review:%s:%d:%s -->", path, line, hash)
+}
+
+// parseProvenanceMarker extracts the path, line and hash from the marker in a comment body
+func parseProvenanceMarker(body string) (path string, line int, hash string, ok bool) {
+	match := provenanceMarkerRegex.FindStringSubmatch(body)
+	if match == nil {
+		return "", 0, "", false
+	}
+	line, err := strconv.Atoi(match[2])
+	if err != nil {
+		return "", 0, "", false
+	}
+	return match[1], line, match[3], true
+}
+
+// addReviewMarker appends the provenance marker to each comment body and prepends its prefix.
+// The hash covers the body without the prefix, so changing the prefix doesn't defeat deduplication.
+func addReviewMarker(comments []Comment) []Comment {
+	for i := range comments {
+		marker := formatProvenanceMarker(comments[i].Path, comments[i].Line, commentHash(comments[i].Body))
+		comments[i].Body = withCommentPrefix(comments[i].Prefix, comments[i].Body) + "\n\n" + marker
+	}
+	return comments
+}
+
+// withCommentPrefix prepends prefix to body, separated by a space unless the prefix ends with one
+func withCommentPrefix(prefix, body string) string {
+	if strings.TrimSpace(prefix) == "" {
+		return body
+	}
+	if strings.TrimRight(prefix, " \t\n") == prefix {
+		prefix += " "
+	}
+	return prefix + body
+}
+
+// hasReviewMarker reports whether a comment body was posted by the action
+func hasReviewMarker(body string) bool {
+	return strings.Contains(body, reviewMarkerPrefix+":") || strings.Contains(body, legacyReviewMarker)
+}
+
+// reviewFingerprint hashes a review body with the provenance markers of its comments, which
+// identify each comment's location and content without its prefix
+func reviewFingerprint(body string, comments []Comment) string {
+	var sb strings.Builder
+	sb.WriteString(body)
+	for _, comment := range comments {
+		identity := provenanceMarkerRegex.FindString(comment.Body)
+		if identity == "" {
+			identity = comment.Body
+		}
+		sb.WriteString("\x00" + identity)
+	}
+	return commentHash(sb.String())
+}
+
+// countResolvedFindings compares the findings of earlier runs, read from the provenance markers in
+// priorBodies, with the current comments. A prior finding is still flagged when a current comment
+// on the same file has the same text or the same line. Comments without a marker are ignored.
+func countResolvedFindings(priorBodies []string, comments []Comment) (resolved, prior int) {
+	type finding struct{ path, hash string }
+	current := map[finding]bool{}
+	currentLines := map[string]bool{}
+	for _, comment := range comments {
+		current[finding{comment.Path, commentHash(comment.Body)}] = true
+		currentLines[fmt.Sprintf("%s:%d", comment.Path, comment.Line)] = true
+	}
+
+	seen := map[finding]bool{}
+	for _, body := range priorBodies {
+		path, line, hash, ok := parseProvenanceMarker(body)
+		if !ok || seen[finding{path, hash}] {
+			continue
+		}
+		seen[finding{path, hash}] = true
+		prior++
+		if !current[finding{path, hash}] && !currentLines[fmt.Sprintf("%s:%d", path, line)] {
+			resolved++
+		}
+	}
+	return resolved, prior
+}
+
+// formatResolvedReport renders how many findings of earlier runs are gone for the job summary
+func formatResolvedReport(resolved, prior int) string {
+	return fmt.Sprintf("### Earlier Gemini findings\n\n%d of %d finding(s) from earlier runs appear resolved, they are no longer flagged.\n", resolved, prior)
+}
+
+// formatReviewBodyMarker returns the hidden marker for a review body with the given fingerprint
+func formatReviewBodyMarker(fingerprint string) string {
+	return reviewBodyMarkerPrefix + fingerprint + " -->"
+}
+
+// parseReviewBodyMarker extracts the fingerprint from the marker in a review body
+func parseReviewBodyMarker(body string) (string, bool) {
+	match := reviewBodyMarkerRegex.FindStringSubmatch(body)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProvenanceMarker(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantPath string
+		wantLine int
+		wantHash string
+		wantOK   bool
+	}{
+		{"marker", "**Info:** x\n\n<!-- gemini-review:main.go:12:0123456789ab -->", "main.go", 12, "0123456789ab", true},
+		{"formatted", formatProvenanceMarker("a.go", 7, commentHash("x")), "a.go", 7, commentHash("x"), true},
+		{"colon in path", "<!-- gemini-review:dir/a:b.go:3:abcdef -->", "dir/a:b.go", 3, "abcdef", true},
+		{"legacy marker", "body\n\n<!-- gemini-review -->", "", 0, "", false},
+		{"no marker", "plain comment", "", 0, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, line, hash, ok := parseProvenanceMarker(tt.body)
+			if path != tt.wantPath || line != tt.wantLine || hash != tt.wantHash || ok != tt.wantOK {
+				t.Errorf("parseProvenanceMarker() = %q, %d, %q, %v, want %q, %d, %q, %v",
+					path, line, hash, ok, tt.wantPath, tt.wantLine, tt.wantHash, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestReviewFingerprint(t *testing.T) {
+	withoutPrefix := addReviewMarker([]Comment{{Path: "a.go", Line: 2, Body: "**Info:** x"}})
+	moved := addReviewMarker([]Comment{{Path: "a.go", Line: 3, Body: "**Info:** x"}})
+
+	base := reviewFingerprint("body", withoutPrefix)
+	if got := reviewFingerprint("body", addReviewMarker([]Comment{{Path: "a.go", Line: 2, Body: "**Info:** x"}})); got != base {
+		t.Errorf("fingerprint changed between runs: %s != %s", got, base)
+	}
+	if got := reviewFingerprint("body", moved); got == base {
+		t.Error("fingerprint unchanged after moving the comment")
+	}
+	if got := reviewFingerprint("other body", withoutPrefix); got == base {
+		t.Error("fingerprint unchanged after changing the body")
+	}
+}
+
+func TestParseReviewBodyMarker(t *testing.T) {
+	tests := []struct {
+		body   string
+		want   string
+		wantOK bool
+	}{
+		{"Summary\n\n" + formatReviewBodyMarker("abc123"), "abc123", true},
+		{"Summary\n\n<!-- gemini-review -->", "", false},
+		{"<!-- gemini-review-body:XYZ -->", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := parseReviewBodyMarker(tt.body)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseReviewBodyMarker(%q) = %q, %v, want %q, %v", tt.body, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestAddReviewMarker(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   string
+	}{
+		{"no prefix", "", "**Info:** x"},
+		{"prefix gets a space", "[bot]", "[bot] **Info:** x"},
+		{"prefix ending in a newline", "Gemini:\n", "Gemini:\n**Info:** x"},
+		{"blank prefix", "  ", "**Info:** x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			comments := addReviewMarker([]Comment{{Path: "a.go", Line: 2, Prefix: tt.prefix, Body: "**Info:** x"}})
+			marker := formatProvenanceMarker("a.go", 2, commentHash("**Info:** x"))
+			if want := tt.want + "\n\n" + marker; comments[0].Body != want {
+				t.Errorf("Body = %q, want %q", comments[0].Body, want)
+			}
+			if !hasReviewMarker(comments[0].Body) {
+				t.Errorf("hasReviewMarker() = false for %q", comments[0].Body)
+			}
+		})
+	}
+}
+
+func TestReviewFingerprintIgnoresPrefix(t *testing.T) {
+	withPrefix := addReviewMarker([]Comment{{Path: "a.go", Line: 2, Prefix: "[bot]", Body: "**Info:** x"}})
+	withoutPrefix := addReviewMarker([]Comment{{Path: "a.go", Line: 2, Body: "**Info:** x"}})
+	if reviewFingerprint("body", withPrefix) != reviewFingerprint("body", withoutPrefix) {
+		t.Error("fingerprint changed with the comment prefix")
+	}
+}
+
+func TestCountResolvedFindings(t *testing.T) {
+	prior := func(path string, line int, body string) string {
+		return body + "\n\n" + formatProvenanceMarker(path, line, commentHash(body))
+	}
+	priorBodies := []string{
+		prior("a.go", 1, "**Info:** still there"),
+		prior("a.go", 1, "**Info:** still there"),
+		prior("a.go", 5, "**Warning:** reworded"),
+		prior("a.go", 9, "**Critical:** fixed"),
+		"a comment without a marker",
+	}
+	comments := []Comment{
+		{Path: "a.go", Line: 3, Body: "**Info:** still there"},
+		{Path: "a.go", Line: 5, Body: "**Warning:** said differently"},
+	}
+	resolved, total := countResolvedFindings(priorBodies, comments)
+	if resolved != 1 || total != 3 {
+		t.Errorf("countResolvedFindings() = %d, %d, want 1, 3", resolved, total)
+	}
+	if report := formatResolvedReport(resolved, total); !strings.Contains(report, "1 of 3") {
+		t.Errorf("formatResolvedReport() = %q", report)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileMetrics summarizes the Gemini usage for one file of the review
+type FileMetrics struct {
+	Path        string
+	Requests    int
+	Latency     time.Duration // total time spent waiting for Gemini
+	InputTokens int           // estimated, see estimateTokens
+	Comments    int
+}
+
+// metricsRecorder accumulates FileMetrics in the order files are reviewed. A nil recorder
+// records nothing.
+type metricsRecorder struct {
+	mu    sync.Mutex // files are reviewed concurrently
+	files []*FileMetrics
+	index map[string]*FileMetrics
+}
+
+func (m *metricsRecorder) record(path string, latency time.Duration, inputTokens, comments int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.index == nil {
+		m.index = map[string]*FileMetrics{}
+	}
+	file, ok := m.index[path]
+	if !ok {
+		file = &FileMetrics{Path: path}
+		m.index[path] = file
+		m.files = append(m.files, file)
+	}
+	file.Requests++
+	file.Latency += latency
+	file.InputTokens += inputTokens
+	file.Comments += comments
+}
+
+// Files returns the recorded metrics, one entry per file
+func (m *metricsRecorder) Files() []FileMetrics {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	files := make([]FileMetrics, 0, len(m.files))
+	for _, file := range m.files {
+		files = append(files, *file)
+	}
+	return files
+}
+
+// formatMetricsTable renders the metrics as a markdown table with a total row
+func formatMetricsTable(files []FileMetrics) string {
+	var sb strings.Builder
+	sb.WriteString("### Gemini review metrics\n\n")
+	sb.WriteString("| File | Requests | Latency | Est. input tokens | Comments |\n")
+	sb.WriteString("| --- | ---: | ---: | ---: | ---: |\n")
+
+	var total FileMetrics
+	for _, file := range files {
+		fmt.Fprintf(&sb, "| `%s` | %d | %s | %d | %d |\n", file.Path, file.Requests, file.Latency.Round(time.Millisecond), file.InputTokens, file.Comments)
+		total.Requests += file.Requests
+		total.Latency += file.Latency
+		total.InputTokens += file.InputTokens
+		total.Comments += file.Comments
+	}
+	fmt.Fprintf(&sb, "| **Total** | %d | %s | %d | %d |\n", total.Requests, total.Latency.Round(time.Millisecond), total.InputTokens, total.Comments)
+	return sb.String()
+}
+
+// appendStepSummary appends markdown to the file at $GITHUB_STEP_SUMMARY.
+// It does nothing when the variable is unset, e.g. outside GitHub Actions.
+func appendStepSummary(markdown string) error {
+	path := os.Getenv("GITHUB_STEP_SUMMARY")
+	if path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open step summary: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(markdown + "\n"); err != nil {
+		return fmt.Errorf("failed to write step summary: %v", err)
+	}
+	return nil
+}
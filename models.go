@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Share of common words above which two comments on the same line count as the same finding
+const similarCommentThreshold = 0.5
+
+// analyzeWithModels reviews the files with Model, then with each of ExtraModels, and merges their
+// findings. A model failing only loses its own findings: an error is returned when every model failed.
+func (r *Reviewer) analyzeWithModels(ctx context.Context, parsedFiles []ParsedFile, title, description string) ([]Comment, error) {
+	var merged []Comment
+	var firstErr error
+	succeeded := false
+	for _, model := range append([]string{r.Model}, r.ExtraModels...) {
+		single := *r
+		single.Model = model
+		single.ExtraModels = nil
+		comments, err := single.analyzeCodeUsingGemini(ctx, parsedFiles, title, description)
+		merged = mergeModelComments(merged, comments)
+		if err != nil {
+			if ctx.Err() != nil {
+				return merged, err
+			}
+			fmt.Printf("Warning: review with %s failed: %v\n", model, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		succeeded = true
+	}
+	if !succeeded {
+		return merged, firstErr
+	}
+	return merged, nil
+}
+
+// mergeModelComments adds the comments of another model to merged, dropping those that repeat a
+// finding already on the same line. The more severe of two duplicates is kept.
+func mergeModelComments(merged, comments []Comment) []Comment {
+	existing := len(merged)
+next:
+	for _, comment := range comments {
+		for i := 0; i < existing; i++ {
+			if sameFinding(merged[i], comment) {
+				if severityRank(comment.Severity) > severityRank(merged[i].Severity) {
+					merged[i] = comment
+				}
+				continue next
+			}
+		}
+		merged = append(merged, comment)
+	}
+	return merged
+}
+
+// sameFinding reports whether two comments are on the same lines and say much the same thing
+func sameFinding(a, b Comment) bool {
+	if a.Path != b.Path || a.Line != b.Line || a.Side != b.Side {
+		return false
+	}
+	return wordSimilarity(commentSummary(a.Body), commentSummary(b.Body)) >= similarCommentThreshold
+}
+
+// wordSimilarity is the share of distinct words two texts have in common, from 0 to 1
+func wordSimilarity(a, b string) float64 {
+	wordsA, wordsB := commentWords(a), commentWords(b)
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0
+	}
+	common := 0
+	for word := range wordsA {
+		if wordsB[word] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(wordsA)+len(wordsB)-common)
+}
+
+// commentWords returns the distinct lowercase words of a comment, without punctuation
+func commentWords(text string) map[string]bool {
+	words := map[string]bool{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r > 127)
+	}) {
+		words[word] = true
+	}
+	return words
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMergeModelComments(t *testing.T) {
+	base := Comment{Path: "a.go", Line: 4, Side: SideRight, Severity: SeverityInfo, Body: "**Info:** The error returned by run is ignored"}
+	tests := []struct {
+		name     string
+		comment  Comment
+		wantLen  int
+		wantBody string
+	}{
+		{
+			name:     "same finding reworded",
+			comment:  Comment{Path: "a.go", Line: 4, Side: SideRight, Severity: SeverityInfo, Body: "**Info:** The error returned by run is silently ignored"},
+			wantLen:  1,
+			wantBody: base.Body,
+		},
+		{
+			name:     "more severe duplicate wins",
+			comment:  Comment{Path: "a.go", Line: 4, Side: SideRight, Severity: SeverityCritical, Body: "**Critical:** The error returned by run is ignored here"},
+			wantLen:  1,
+			wantBody: "**Critical:** The error returned by run is ignored here",
+		},
+		{
+			name:     "different finding on the same line",
+			comment:  Comment{Path: "a.go", Line: 4, Side: SideRight, Severity: SeverityInfo, Body: "**Info:** Rename ctx to something clearer"},
+			wantLen:  2,
+			wantBody: base.Body,
+		},
+		{
+			name:     "same text on another line",
+			comment:  Comment{Path: "a.go", Line: 5, Side: SideRight, Severity: SeverityInfo, Body: base.Body},
+			wantLen:  2,
+			wantBody: base.Body,
+		},
+		{
+			name:     "same text on the other side",
+			comment:  Comment{Path: "a.go", Line: 4, Side: SideLeft, Severity: SeverityInfo, Body: base.Body},
+			wantLen:  2,
+			wantBody: base.Body,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged := mergeModelComments([]Comment{base}, []Comment{tt.comment})
+			if len(merged) != tt.wantLen {
+				t.Fatalf("got %d comments, want %d", len(merged), tt.wantLen)
+			}
+			if merged[0].Body != tt.wantBody {
+				t.Errorf("first body = %q, want %q", merged[0].Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestWordSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"Close the file", "close the FILE.", 1},
+		{"close the file", "open the door", 0.2},
+		{"", "anything", 0},
+	}
+	for _, tt := range tests {
+		if got := wordSimilarity(tt.a, tt.b); got != tt.want {
+			t.Errorf("wordSimilarity(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestAnalyzeWithModels(t *testing.T) {
+	files, err := parseDiff(sampleDiff)
+	if err != nil {
+		t.Fatalf("parseDiff: %v", err)
+	}
+	const (
+		found   = `[{"severity":"warning","comment":"Handle the error returned by run","line":9}]`
+		another = `[{"severity":"critical","comment":"Handle the error returned by run here","line":9},{"severity":"info","comment":"Log with context","line":10}]`
+	)
+	tests := []struct {
+		name    string
+		extra   []string
+		models  map[string]fakeModel
+		want    map[string]int // comments per model
+		wantErr bool
+	}{
+		{
+			name:   "findings merged",
+			extra:  []string{"flash"},
+			models: map[string]fakeModel{"pro": {text: found}, "flash": {text: another}},
+			// The critical duplicate replaces the warning of the first model
+			want: map[string]int{"flash": 6},
+		},
+		{
+			name:   "a failing model loses only its findings",
+			extra:  []string{"flash"},
+			models: map[string]fakeModel{"pro": {status: http.StatusBadRequest}, "flash": {text: found}},
+			want:   map[string]int{"flash": 3},
+		},
+		{
+			name:    "every model failing is an error",
+			extra:   []string{"flash"},
+			models:  map[string]fakeModel{"pro": {status: http.StatusBadRequest}, "flash": {status: http.StatusBadRequest}},
+			want:    map[string]int{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestReviewer(t, "pro", tt.models)
+			r.ExtraModels = tt.extra
+			comments, err := r.analyzeCodeUsingGemini(context.Background(), files, "title", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			got := map[string]int{}
+			for _, comment := range comments {
+				got[comment.Model]++
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("comments per model = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveGeminiModels(t *testing.T) {
+	tests := []struct {
+		name   string
+		models string
+		model  string
+		want   []string
+	}{
+		{"list", "gemini-2.5-pro, models/Gemini-2.5-Flash", "", []string{"gemini-2.5-pro", "gemini-2.5-flash"}},
+		{"duplicates dropped", "gemini-2.5-pro,gemini-2.5-pro", "", []string{"gemini-2.5-pro"}},
+		{"single model", "", "gemini-2.5-flash", []string{"gemini-2.5-flash"}},
+		{"default", "", "", []string{defaultGeminiModel}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("INPUT_GEMINI_MODELS", tt.models)
+			t.Setenv("INPUT_GEMINI_MODEL", tt.model)
+			t.Setenv("GEMINI_MODEL", "")
+			if got := resolveGeminiModels(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveGeminiModels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// defaultTestPatterns match common test file layouts, excluded by INPUT_SKIP_TESTS
+var defaultTestPatterns = []string{
+	"**/*_test.go",
+	"**/*.test.js", "**/*.spec.js", "**/*.test.ts", "**/*.spec.ts", "**/*.test.tsx", "**/*.spec.tsx",
+	"**/test_*.py", "**/*_test.py",
+	"test/**", "tests/**", "**/__tests__/**",
+}
+
+// matchPathPattern reports whether path matches pattern. Patterns without wildcards match the
+// path itself and everything below it; otherwise * matches within a path segment, ** across
+// segments and ? a single character, e.g. "src/**" or "**/*_test.go".
+func matchPathPattern(pattern, path string) bool {
+	pattern = strings.TrimPrefix(strings.TrimSpace(pattern), "/")
+	if pattern == "" {
+		return false
+	}
+	if !strings.ContainsAny(pattern, "*?") {
+		prefix := strings.TrimSuffix(pattern, "/")
+		return path == prefix || strings.HasPrefix(path, prefix+"/")
+	}
+	return globRegex(pattern).MatchString(path)
+}
+
+// globRegex translates a path glob into an anchored regular expression
+func globRegex(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+// matchesAnyPath reports whether path matches one of the patterns
+func matchesAnyPath(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if matchPathPattern(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterFilesByPath keeps the files matching one of the include patterns, or every file when
+// there are none, and drops those matching an exclude pattern
+func filterFilesByPath(files []ParsedFile, include, exclude []string) []ParsedFile {
+	var filtered []ParsedFile
+	for _, file := range files {
+		if len(include) > 0 && !matchesAnyPath(include, file.Path) {
+			continue
+		}
+		if matchesAnyPath(exclude, file.Path) {
+			continue
+		}
+		filtered = append(filtered, file)
+	}
+	return filtered
+}
+
+// normalizeRootDir cleans a directory input into a repository-relative path without slashes
+// at either end, e.g. "./services/api/" becomes "services/api"
+func normalizeRootDir(dir string) string {
+	dir = strings.TrimSpace(dir)
+	dir = strings.TrimPrefix(dir, "./")
+	return strings.Trim(dir, "/")
+}
+
+// filterFilesUnderDir keeps the files below dir, or every file when dir is empty
+func filterFilesUnderDir(files []ParsedFile, dir string) []ParsedFile {
+	if dir == "" {
+		return files
+	}
+	var kept []ParsedFile
+	for _, file := range files {
+		if strings.HasPrefix(file.Path, dir+"/") {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
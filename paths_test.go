@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMatchPathPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"src/**", "src/main.go", true},
+		{"src/**", "src/pkg/util/util.go", true},
+		{"src/**", "docs/src/readme.md", false},
+		{"src", "src/main.go", true},
+		{"src/", "src/main.go", true},
+		{"src", "srcs/main.go", false},
+		{"/src/*.go", "src/main.go", true},
+		{"src/*.go", "src/pkg/util.go", false},
+		{"**/*_test.go", "main_test.go", true},
+		{"**/*_test.go", "pkg/a/b_test.go", true},
+		{"?.go", "a.go", true},
+		{"?.go", "ab.go", false},
+		{"", "a.go", false},
+	}
+	for _, tt := range tests {
+		if got := matchPathPattern(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("matchPathPattern(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFilterFilesByPath(t *testing.T) {
+	files := []ParsedFile{{Path: "README.md"}, {Path: "src/main.go"}, {Path: "src/gen/api.pb.go"}, {Path: "test/src/a.go"}}
+	tests := []struct {
+		name    string
+		paths   string
+		exclude string
+		want    []string
+	}{
+		{"no filter", "", "", []string{"README.md", "src/main.go", "src/gen/api.pb.go", "test/src/a.go"}},
+		{"include", "src/**", "", []string{"src/main.go", "src/gen/api.pb.go"}},
+		{"include and exclude", "src/**", "**/*.pb.go", []string{"src/main.go"}},
+		{"exclude only", "", "src/gen, *.md", []string{"src/main.go", "test/src/a.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("INPUT_PATHS", tt.paths)
+			t.Setenv("INPUT_EXCLUDE", tt.exclude)
+			filtered := filterFilesByPath(files, parseListInput(os.Getenv("INPUT_PATHS")), parseListInput(os.Getenv("INPUT_EXCLUDE")))
+			var got []string
+			for _, file := range filtered {
+				got = append(got, file.Path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
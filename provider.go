@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Supported values of INPUT_PROVIDER
+const (
+	providerGitHub    = "github"
+	providerGitLab    = "gitlab"
+	providerBitbucket = "bitbucket"
+)
+
+// ReviewProvider is the forge hosting the changes: it supplies the diff and receives the review
+type ReviewProvider interface {
+	// FetchDiff returns the changes as a unified diff
+	FetchDiff(ctx context.Context) (string, error)
+	// PostReview posts the review body and its inline comments
+	PostReview(ctx context.Context, body string, comments []Comment) error
+}
+
+// outdatedCommentMinimizer is implemented by providers that can hide the comments of earlier runs
+// on lines that have since changed. It returns how many comments were hidden.
+type outdatedCommentMinimizer interface {
+	MinimizeOutdated(ctx context.Context) (int, error)
+}
+
+// priorCommentLister is implemented by providers that can list the comments of the pull request,
+// so the findings of earlier runs can be compared with the current ones
+type priorCommentLister interface {
+	PriorCommentBodies(ctx context.Context) ([]string, error)
+}
+
+// concludedReviewPoster is implemented by providers that report a review with a conclusion, like
+// a check run or a commit status. Reviews that didn't cover the whole PR are posted through it, so
+// they don't get the clean conclusion of a review without findings.
+type concludedReviewPoster interface {
+	PostReviewWithConclusion(ctx context.Context, body string, comments []Comment, conclusion string) error
+}
+
+// postReview posts the review with conclusion when the provider supports one. An empty conclusion
+// is derived from the comments.
+func postReview(ctx context.Context, provider ReviewProvider, body string, comments []Comment, conclusion string) error {
+	if poster, ok := provider.(concludedReviewPoster); ok && conclusion != "" {
+		return poster.PostReviewWithConclusion(ctx, body, comments, conclusion)
+	}
+	return provider.PostReview(ctx, body, comments)
+}
+
+// parseProvider validates INPUT_PROVIDER, defaulting to GitHub
+func parseProvider(value string) (string, error) {
+	switch provider := strings.ToLower(strings.TrimSpace(value)); provider {
+	case "", providerGitHub:
+		return providerGitHub, nil
+	case providerGitLab, providerBitbucket:
+		return provider, nil
+	default:
+		return "", fmt.Errorf("unsupported provider %q (expected %q, %q or %q)", value, providerGitHub, providerGitLab, providerBitbucket)
+	}
+}
+
+// parsedFileFetcher is implemented by providers that can list the changed files with their hunks
+// without a unified diff
+type parsedFileFetcher interface {
+	FetchParsedFiles(ctx context.Context) ([]ParsedFile, error)
+}
+
+// diffTooLargeError reports a diff over INPUT_MAX_DIFF_BYTES, which is neither parsed nor reviewed
+type diffTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *diffTooLargeError) Error() string {
+	return fmt.Sprintf("the diff is %d bytes, over INPUT_MAX_DIFF_BYTES of %d", e.Size, e.Limit)
+}
+
+// fetchParsedFiles returns the changed files of the review, parsing the provider's diff unless it
+// lists them directly. A diff over maxDiffBytes, when it is positive, is a diffTooLargeError.
+func fetchParsedFiles(ctx context.Context, provider ReviewProvider, maxDiffBytes int) ([]ParsedFile, error) {
+	if fetcher, ok := provider.(parsedFileFetcher); ok {
+		files, err := fetcher.FetchParsedFiles(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch the changed files: %v", err)
+		}
+		// There is no raw diff, the size of the listed patches stands in for it
+		if size := diffSize(files); maxDiffBytes > 0 && size > maxDiffBytes {
+			return nil, &diffTooLargeError{Size: size, Limit: maxDiffBytes}
+		}
+		return files, nil
+	}
+
+	diff, err := provider.FetchDiff(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch diff: %v", err)
+	}
+	// Checked before parsing, a huge diff isn't worth the work
+	if maxDiffBytes > 0 && len(diff) > maxDiffBytes {
+		return nil, &diffTooLargeError{Size: len(diff), Limit: maxDiffBytes}
+	}
+	files, err := parseDiff(diff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse diff: %v", err)
+	}
+	return files, nil
+}
+
+// reviewOptions are the inputs shaping a review, whatever the provider
+type reviewOptions struct {
+	MaxHunkLines         int
+	IncludePaths         []string
+	ExcludePaths         []string
+	MaxInputTokens       int
+	MaxCommentsPerFile   int
+	CommentOnSuccess     bool // post a review even when Gemini finds nothing
+	MetricsSummary       bool
+	IncludeSummary       bool // use a Gemini summary of the whole PR as the review body
+	MinSeverity          string
+	InlineMinSeverity    string // less severe comments go to the review body instead of inline
+	MergeSameLine        bool   // combine comments on the same line into one thread
+	GroupBySeverity      bool   // list the review body findings in a section per severity
+	MaxFiles             int
+	OnlyNewFiles         bool   // skip modified files, review only the ones the PR adds
+	OnlyFile             string // review this one path only, e.g. to iterate on a prompt
+	IgnoreWhitespace     bool   // skip hunks that only change whitespace
+	ReportResolved       bool   // note in the job summary how many earlier findings are gone
+	ReviewDescription    bool   // also check the PR description against DescriptionChecklist
+	DescriptionChecklist []string
+	PartialResults       bool
+	TimeoutSeconds       int
+	Preflight            bool     // check the Gemini credentials once there is something to review
+	CommentPrefix        string   // banner in front of every comment, e.g. "🤖 Gemini:"
+	TestPatterns         []string // test files to leave out, empty to review them
+	MaxDiffBytes         int      // PRs with a larger diff aren't reviewed, 0 for no limit
+	RootDir              string   // only review files below this directory, for monorepos
+}
+
+// runReview fetches the diff from provider, reviews it with Gemini and posts the findings back
+func runReview(ctx context.Context, provider ReviewProvider, reviewer *Reviewer, title, description string, opts reviewOptions) error {
+	parsedFiles, err := fetchParsedFiles(ctx, provider, opts.MaxDiffBytes)
+	// Huge PRs, e.g. generated code, get a note instead of a review
+	var tooLarge *diffTooLargeError
+	if errors.As(err, &tooLarge) {
+		fmt.Printf("The diff is %d bytes, over INPUT_MAX_DIFF_BYTES of %d. Skipping review.\n", tooLarge.Size, tooLarge.Limit)
+		body := fmt.Sprintf("This PR is too large for an automated review: its diff is %d bytes, over the limit of %d bytes.", tooLarge.Size, tooLarge.Limit)
+		// Neutral rather than the success of a clean review, nothing was reviewed
+		if err := postReview(ctx, provider, body, nil, conclusionNeutral); err != nil {
+			return fmt.Errorf("failed to post comments: %v", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(parsedFiles) == 0 {
+		fmt.Println("The PR has no changed files. Skipping review.")
+		return nil
+	}
+
+	parsedFiles = filterReviewableFiles(parsedFiles)
+	if len(parsedFiles) == 0 {
+		fmt.Println("No reviewable changes found (only deleted, binary or empty files). Skipping review.")
+		return nil
+	}
+
+	// Scope the review to one service of a monorepo
+	if opts.RootDir != "" {
+		parsedFiles = filterFilesUnderDir(parsedFiles, opts.RootDir)
+		if len(parsedFiles) == 0 {
+			fmt.Printf("No changed files under %s. Skipping review.\n", opts.RootDir)
+			return nil
+		}
+	}
+
+	// Only review the paths the team asked for
+	parsedFiles = filterFilesByPath(parsedFiles, opts.IncludePaths, opts.ExcludePaths)
+	if len(parsedFiles) == 0 {
+		fmt.Println("No changed files match INPUT_PATHS and INPUT_EXCLUDE. Skipping review.")
+		return nil
+	}
+	if len(opts.TestPatterns) > 0 {
+		parsedFiles = filterFilesByPath(parsedFiles, nil, opts.TestPatterns)
+		if len(parsedFiles) == 0 {
+			fmt.Println("Only test files changed and INPUT_SKIP_TESTS is set. Skipping review.")
+			return nil
+		}
+	}
+	if opts.OnlyFile != "" {
+		parsedFiles = filterOnlyFile(parsedFiles, opts.OnlyFile)
+		if len(parsedFiles) == 0 {
+			fmt.Printf("%s is not changed by the PR, nothing to review for INPUT_ONLY_FILE. Skipping review.\n", opts.OnlyFile)
+			return nil
+		}
+	}
+	if opts.OnlyNewFiles {
+		parsedFiles = filterNewFiles(parsedFiles)
+		if len(parsedFiles) == 0 {
+			fmt.Println("No new files in the PR and INPUT_ONLY_NEW_FILES is set. Skipping review.")
+			return nil
+		}
+	}
+	if opts.IgnoreWhitespace {
+		var dropped int
+		if parsedFiles, dropped = filterWhitespaceOnlyHunks(parsedFiles); dropped > 0 {
+			fmt.Printf("Ignoring %d whitespace-only hunk(s)\n", dropped)
+		}
+		if len(parsedFiles) == 0 {
+			fmt.Println("Only whitespace changed and INPUT_IGNORE_WHITESPACE is set. Skipping review.")
+			return nil
+		}
+	}
+
+	// Fail fast on a bad API key before any file is reviewed. It comes after the checks above, so
+	// PRs with nothing to review never make a Gemini call.
+	if opts.Preflight {
+		if err := checkGemini(ctx, reviewer.Client, reviewer.Model); err != nil {
+			if errors.Is(err, errGeminiAuth) {
+				return &configError{err}
+			}
+			return fmt.Errorf("gemini preflight failed: %v", err)
+		}
+	}
+
+	reviewBody := "Automated review by Gemini AI"
+	truncationNote := ""
+	if opts.MaxFiles > 0 && len(parsedFiles) > opts.MaxFiles {
+		fmt.Printf("Reviewing the first %d of %d files\n", opts.MaxFiles, len(parsedFiles))
+		truncationNote = fmt.Sprintf("\n\nOnly the first %d of %d changed files were reviewed.", opts.MaxFiles, len(parsedFiles))
+		parsedFiles = parsedFiles[:opts.MaxFiles]
+	}
+
+	parsedFiles = chunkLargeHunks(parsedFiles, opts.MaxHunkLines)
+
+	parsedFiles, skippedFiles, err := applyTokenBudget(reviewer.Prompts, parsedFiles, title, description, opts.MaxInputTokens)
+	if err != nil {
+		return fmt.Errorf("failed to build prompts: %v", err)
+	}
+	if len(skippedFiles) > 0 {
+		fmt.Printf("Token budget of %d reached, skipping %d file(s)\n", opts.MaxInputTokens, len(skippedFiles))
+		truncationNote += "\n\n" + formatSkippedFilesNote(opts.MaxInputTokens, skippedFiles)
+	}
+
+	postCtx := ctx
+	// Set when part of the PR went unreviewed, so the review doesn't conclude clean
+	incomplete := ""
+	comments, err := reviewer.analyzeCodeUsingGemini(ctx, parsedFiles, title, description)
+	// One note rather than a partial review when Gemini looks down
+	var circuit *CircuitOpenError
+	if errors.As(err, &circuit) {
+		if postErr := postReview(ctx, provider, formatReviewUnavailableNote(circuit), nil, conclusionFailure); postErr != nil {
+			fmt.Println("Warning: failed to post the review unavailable note:", postErr)
+		}
+		return fmt.Errorf("failed to analyze code: %v", err)
+	}
+	// Post what was reviewed when only some files failed
+	var failures FileErrors
+	if errors.As(err, &failures) && len(failures) < len(parsedFiles) {
+		truncationNote += "\n\n" + formatFailedFilesNote(failures)
+		incomplete = conclusionNeutral
+		err = nil
+	}
+	if err != nil {
+		timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+		if !timedOut || !opts.PartialResults || len(comments) == 0 {
+			return fmt.Errorf("failed to analyze code: %v", err)
+		}
+
+		// The run context is done, give the partial review its own short deadline
+		fmt.Printf("Review timed out after %d seconds, posting the %d comment(s) generated so far\n", opts.TimeoutSeconds, len(comments))
+		truncationNote += fmt.Sprintf("\n\nReview incomplete: the %d second timeout was reached before every file was analyzed.", opts.TimeoutSeconds)
+		incomplete = conclusionNeutral
+		var postCancel context.CancelFunc
+		postCtx, postCancel = context.WithTimeout(context.Background(), partialPostTimeout)
+		defer postCancel()
+	}
+
+	// The summary is best effort, the inline comments are posted without it
+	summary := ""
+	if opts.IncludeSummary {
+		if summary, err = reviewer.summarizePullRequest(postCtx, title, description, parsedFiles); err != nil {
+			fmt.Println("Warning:", err)
+		}
+	}
+
+	// Like the summary, description feedback is best effort
+	descriptionNote := ""
+	if opts.ReviewDescription {
+		feedback, err := reviewer.reviewDescription(postCtx, title, description, opts.DescriptionChecklist)
+		if err != nil {
+			fmt.Println("Warning:", err)
+		} else if feedback != "" {
+			descriptionNote = "\n\n" + feedback
+		}
+	}
+
+	// Report per-file usage before filtering, it reflects what Gemini produced
+	metricsTable := formatMetricsTable(reviewer.Metrics.Files())
+	fmt.Println(metricsTable)
+	if opts.MetricsSummary {
+		if err := appendStepSummary(metricsTable); err != nil {
+			fmt.Println("Warning:", err)
+		}
+	}
+
+	comments = filterValidComments(comments, parsedFiles)
+	comments = filterBySeverity(comments, opts.MinSeverity)
+	comments = limitCommentsPerFile(comments, opts.MaxCommentsPerFile)
+	sortComments(comments)
+
+	if err := appendStepSummary(formatFindingsTable(comments)); err != nil {
+		fmt.Println("Warning:", err)
+	}
+	// Compared before posting, so the earlier comments are the only ones listed
+	if lister, ok := provider.(priorCommentLister); ok && opts.ReportResolved {
+		if bodies, err := lister.PriorCommentBodies(postCtx); err != nil {
+			fmt.Println("Warning: failed to list earlier comments:", err)
+		} else if resolved, prior := countResolvedFindings(bodies, comments); prior > 0 {
+			fmt.Printf("%d of %d earlier finding(s) are no longer flagged\n", resolved, prior)
+			if err := appendStepSummary(formatResolvedReport(resolved, prior)); err != nil {
+				fmt.Println("Warning:", err)
+			}
+		}
+	}
+
+	// Less severe findings are listed in the review body rather than as separate threads
+	summarizedNote := ""
+	comments, summarized := splitInlineComments(comments, opts.InlineMinSeverity)
+	if len(summarized) > 0 {
+		if opts.GroupBySeverity {
+			summarizedNote = "\n\n" + formatCommentsBySeverity(summarized)
+		} else {
+			summarizedNote = "\n\n" + formatSummarizedComments(summarized)
+		}
+	}
+	if opts.MergeSameLine {
+		comments = mergeSameLineComments(comments)
+	}
+	for i := range comments {
+		comments[i].Prefix = opts.CommentPrefix
+	}
+
+	// Earlier comments on lines that have since changed would only add noise
+	if minimizer, ok := provider.(outdatedCommentMinimizer); ok {
+		minimized, err := minimizer.MinimizeOutdated(postCtx)
+		if err != nil {
+			fmt.Println("Warning: failed to minimize outdated comments:", err)
+		} else if minimized > 0 {
+			fmt.Printf("Minimized %d outdated comment(s)\n", minimized)
+		}
+	}
+
+	// Stay silent when there is nothing to report, unless asked to confirm a clean review
+	switch {
+	case summary != "":
+		reviewBody = summary
+	case len(comments) > 0:
+	// Findings listed in the body only aren't "no issues"
+	case summarizedNote != "":
+	case opts.CommentOnSuccess && incomplete == "":
+		reviewBody = "Gemini found no issues."
+	case truncationNote == "" && descriptionNote == "":
+		fmt.Println("Gemini found no issues. Nothing to post.")
+		return nil
+	}
+	reviewBody += summarizedNote + descriptionNote + truncationNote
+
+	if err := postReview(postCtx, provider, reviewBody, comments, incomplete); err != nil {
+		// Keep the findings in the job summary so the Gemini work isn't lost
+		if summaryErr := appendStepSummary(formatUnpostedReview(reviewBody, comments)); summaryErr != nil {
+			fmt.Println("Warning:", summaryErr)
+		}
+		return fmt.Errorf("failed to post comments: %v", err)
+	}
+	fmt.Println("Review comments posted successfully.")
+	return nil
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postedReview is a review received by fakeProvider
+type postedReview struct {
+	body       string
+	comments   []Comment
+	conclusion string
+}
+
+// fakeProvider serves a fixed diff and records the reviews posted to it
+type fakeProvider struct {
+	diff     string
+	fetchErr error
+	postErr  error
+	fetches  int
+	posted   []postedReview
+}
+
+func (p *fakeProvider) FetchDiff(ctx context.Context) (string, error) {
+	p.fetches++
+	return p.diff, p.fetchErr
+}
+
+func (p *fakeProvider) PostReview(ctx context.Context, body string, comments []Comment) error {
+	return p.PostReviewWithConclusion(ctx, body, comments, "")
+}
+
+func (p *fakeProvider) PostReviewWithConclusion(ctx context.Context, body string, comments []Comment, conclusion string) error {
+	p.posted = append(p.posted, postedReview{body, comments, conclusion})
+	return p.postErr
+}
+
+// fakeFilesProvider lists the changed files directly, like the GitHub files API
+type fakeFilesProvider struct {
+	fakeProvider
+	files []ParsedFile
+}
+
+func (p *fakeFilesProvider) FetchParsedFiles(ctx context.Context) ([]ParsedFile, error) {
+	p.fetches++
+	return p.files, p.fetchErr
+}
+
+// newUncalledReviewer returns a Reviewer whose Gemini API fails the test when it is called at all
+func newUncalledReviewer(t *testing.T) *Reviewer {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected Gemini call to %s", r.URL.Path)
+		http.Error(w, "unexpected call", http.StatusInternalServerError)
+	}))
+	t.Cleanup(srv.Close)
+
+	client := NewGeminiClient("key", srv.Client())
+	client.BaseURL = srv.URL
+	return &Reviewer{Client: client, Model: "pro", Prompts: newTestPrompts(t)}
+}
+
+// addedFileDiff returns the diff of a new file with the given lines
+func addedFileDiff(path string, lines ...string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "diff --git a/%s b/%s\nnew file mode 100644\n--- /dev/null\n+++ b/%s\n@@ -0,0 +1,%d @@\n", path, path, path, len(lines))
+	for _, line := range lines {
+		sb.WriteString("+" + line + "\n")
+	}
+	return sb.String()
+}
+
+// finding is a Gemini answer with one warning on line 1
+const finding = `[{"severity":"warning","comment":"Handle the error","line":1}]`
+
+func TestRunReview(t *testing.T) {
+	t.Setenv("GITHUB_STEP_SUMMARY", "")
+	twoFiles := addedFileDiff("a.go", "run()") + addedFileDiff("b.go", "stop()")
+	tests := []struct {
+		name        string
+		diff        string
+		gemini      fakeModel
+		opts        reviewOptions
+		wantErr     bool
+		wantCalls   int
+		wantPosted  []postedReview
+		wantBodyHas string
+	}{
+		{
+			name:      "success",
+			diff:      twoFiles,
+			gemini:    fakeModel{text: finding},
+			wantCalls: 2,
+			wantPosted: []postedReview{{
+				body: "Automated review by Gemini AI",
+				comments: []Comment{
+					{Path: "a.go", Line: 1, Side: SideRight, Severity: SeverityWarning, Body: "**Warning:** Handle the error", Model: "pro"},
+					{Path: "b.go", Line: 1, Side: SideRight, Severity: SeverityWarning, Body: "**Warning:** Handle the error", Model: "pro"},
+				},
+			}},
+		},
+		{
+			name:      "no findings stays silent",
+			diff:      twoFiles,
+			gemini:    fakeModel{text: "[]"},
+			wantCalls: 2,
+		},
+		{
+			name:      "no findings with comment on success",
+			diff:      twoFiles,
+			gemini:    fakeModel{text: "[]"},
+			opts:      reviewOptions{CommentOnSuccess: true},
+			wantCalls: 2,
+			wantPosted: []postedReview{{
+				body: "Gemini found no issues.",
+			}},
+		},
+		{
+			name: "skipped by the path filter",
+			diff: twoFiles,
+			opts: reviewOptions{IncludePaths: []string{"src/**"}},
+		},
+		{
+			name: "skipped when only tests changed",
+			diff: addedFileDiff("a_test.go", "t.Run()"),
+			opts: reviewOptions{TestPatterns: []string{"**/*_test.go", "*_test.go"}},
+		},
+		{
+			name:        "too large",
+			diff:        twoFiles,
+			opts:        reviewOptions{MaxDiffBytes: 10},
+			wantPosted:  []postedReview{{conclusion: conclusionNeutral}},
+			wantBodyHas: "too large for an automated review",
+		},
+		{
+			name:        "partial failure",
+			diff:        twoFiles,
+			gemini:      fakeModel{text: finding, failOn: "b.go"},
+			wantCalls:   2,
+			wantPosted:  []postedReview{{conclusion: conclusionNeutral}},
+			wantBodyHas: "Gemini failed on the following files, they were not reviewed:\n- `b.go`",
+		},
+		{
+			name:      "every file failing",
+			diff:      twoFiles,
+			gemini:    fakeModel{status: 400},
+			wantCalls: 2,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reviewer, gemini := newTestReviewer(t, "pro", map[string]fakeModel{"pro": tt.gemini})
+			provider := &fakeProvider{diff: tt.diff}
+
+			err := runReview(context.Background(), provider, reviewer, "title", "", tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls := gemini.totalCalls(); calls != tt.wantCalls {
+				t.Errorf("Gemini calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if len(provider.posted) != len(tt.wantPosted) {
+				t.Fatalf("posted %d reviews, want %d", len(provider.posted), len(tt.wantPosted))
+			}
+			for i, want := range tt.wantPosted {
+				got := provider.posted[i]
+				if len(got.comments) == 0 {
+					got.comments = nil
+				}
+				if tt.wantBodyHas != "" {
+					if !strings.Contains(got.body, tt.wantBodyHas) {
+						t.Errorf("body = %q, want it to contain %q", got.body, tt.wantBodyHas)
+					}
+					got.body, got.comments = "", nil
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("posted %+v, want %+v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRunReviewOneFileFailing(t *testing.T) {
+	t.Setenv("GITHUB_STEP_SUMMARY", "")
+	reviewer, gemini := newTestReviewer(t, "pro", map[string]fakeModel{"pro": {text: finding, failOn: "b.go"}})
+	provider := &fakeProvider{diff: addedFileDiff("a.go", "run()") + addedFileDiff("b.go", "stop()") + addedFileDiff("c.go", "wait()")}
+
+	if err := runReview(context.Background(), provider, reviewer, "title", "", reviewOptions{}); err != nil {
+		t.Fatalf("runReview: %v", err)
+	}
+	if calls := gemini.totalCalls(); calls != 3 {
+		t.Errorf("Gemini calls = %d, want every file tried", calls)
+	}
+	if len(provider.posted) != 1 {
+		t.Fatalf("posted %d reviews, want 1", len(provider.posted))
+	}
+	posted := provider.posted[0]
+	var paths []string
+	for _, comment := range posted.comments {
+		paths = append(paths, comment.Path)
+	}
+	if !reflect.DeepEqual(paths, []string{"a.go", "c.go"}) {
+		t.Errorf("comments on %v, want the findings on a.go and c.go", paths)
+	}
+	if posted.conclusion != conclusionNeutral {
+		t.Errorf("conclusion = %q, want %q", posted.conclusion, conclusionNeutral)
+	}
+	if want := "Gemini failed on the following files, they were not reviewed:\n- `b.go`\n"; !strings.Contains(posted.body, want) {
+		t.Errorf("body = %q, want it to contain %q", posted.body, want)
+	}
+}
+
+func TestRunReviewNoChangedFiles(t *testing.T) {
+	diffProvider := &fakeProvider{diff: ""}
+	filesProvider := &fakeFilesProvider{files: []ParsedFile{}}
+	tests := []struct {
+		name     string
+		provider ReviewProvider
+		recorder *fakeProvider
+	}{
+		{"empty diff", diffProvider, diffProvider},
+		{"empty files list", filesProvider, &filesProvider.fakeProvider},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := runReview(context.Background(), tt.provider, newUncalledReviewer(t), "title", "", reviewOptions{Preflight: true})
+			if err != nil {
+				t.Fatalf("runReview: %v", err)
+			}
+			if tt.recorder.fetches != 1 || len(tt.recorder.posted) != 0 {
+				t.Errorf("%d fetches, posted %+v, want 1 fetch and nothing posted", tt.recorder.fetches, tt.recorder.posted)
+			}
+		})
+	}
+}
+
+func TestRunReviewNothingReviewable(t *testing.T) {
+	tests := []struct {
+		name string
+		diff string
+	}{
+		{
+			name: "all deletions",
+			diff: "diff --git a/old.go b/old.go\ndeleted file mode 100644\n--- a/old.go\n+++ /dev/null\n@@ -1,2 +0,0 @@\n-package main\n-\n" +
+				"diff --git a/gone.txt b/gone.txt\ndeleted file mode 100644\n--- a/gone.txt\n+++ /dev/null\n@@ -1 +0,0 @@\n-bye\n",
+		},
+		{
+			name: "all binary",
+			diff: "diff --git a/logo.png b/logo.png\nindex 1111111..2222222 100644\nBinary files a/logo.png and b/logo.png differ\n" +
+				"diff --git a/font.woff b/font.woff\nnew file mode 100644\nBinary files /dev/null and b/font.woff differ\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &fakeProvider{diff: tt.diff}
+			err := runReview(context.Background(), provider, newUncalledReviewer(t), "title", "", reviewOptions{Preflight: true})
+			if err != nil {
+				t.Fatalf("runReview: %v", err)
+			}
+			if len(provider.posted) != 0 {
+				t.Errorf("posted %+v, want nothing", provider.posted)
+			}
+		})
+	}
+}
+
+func TestRunReviewDiffTooLarge(t *testing.T) {
+	// Not a valid diff past the limit: it must be skipped before it is parsed
+	oversized := addedFileDiff("gen.go", strings.Repeat("x", 200)) + "@@ garbage @@\n"
+	diffProvider := &fakeProvider{diff: oversized}
+	files, err := parseDiff(addedFileDiff("gen.go", strings.Repeat("x", 200)))
+	if err != nil {
+		t.Fatalf("parseDiff: %v", err)
+	}
+	filesProvider := &fakeFilesProvider{files: files}
+	tests := []struct {
+		name     string
+		provider ReviewProvider
+		recorder *fakeProvider
+		wantSize int
+	}{
+		{"raw diff", diffProvider, diffProvider, len(oversized)},
+		{"files listing", filesProvider, &filesProvider.fakeProvider, diffSize(files)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := reviewOptions{Preflight: true, MaxDiffBytes: 100}
+			if err := runReview(context.Background(), tt.provider, newUncalledReviewer(t), "title", "", opts); err != nil {
+				t.Fatalf("runReview: %v", err)
+			}
+			want := []postedReview{{
+				body:       fmt.Sprintf("This PR is too large for an automated review: its diff is %d bytes, over the limit of 100 bytes.", tt.wantSize),
+				conclusion: conclusionNeutral,
+			}}
+			if !reflect.DeepEqual(tt.recorder.posted, want) {
+				t.Errorf("posted %+v, want %+v", tt.recorder.posted, want)
+			}
+		})
+	}
+}
+
+func TestRunReviewPreflightAuthFailure(t *testing.T) {
+	reviewer, gemini := newTestReviewer(t, "pro", map[string]fakeModel{"pro": {status: http.StatusUnauthorized}})
+	provider := &fakeProvider{diff: addedFileDiff("a.go", "run()") + addedFileDiff("b.go", "stop()")}
+
+	err := runReview(context.Background(), provider, reviewer, "title", "", reviewOptions{Preflight: true})
+	var config *configError
+	if !errors.As(err, &config) || !errors.Is(err, errGeminiAuth) {
+		t.Fatalf("err = %v, want a configuration error for the credentials", err)
+	}
+	// The preflight is the only call: no file is sent for review
+	if calls := gemini.totalCalls(); calls != 1 {
+		t.Errorf("Gemini calls = %d, want 1", calls)
+	}
+	if len(provider.posted) != 0 {
+		t.Errorf("posted %+v, want nothing", provider.posted)
+	}
+}
+
+func TestRunReviewTimeout(t *testing.T) {
+	t.Setenv("GITHUB_STEP_SUMMARY", "")
+	diff := addedFileDiff("a.go", "run()") + addedFileDiff("b.go", "stop()")
+	tests := []struct {
+		name       string
+		partial    bool
+		wantErr    bool
+		wantPosted int
+	}{
+		{name: "fails without partial results", wantErr: true},
+		{name: "posts the partial results", partial: true, wantPosted: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a.go is answered right away, b.go only after the run timed out
+			reviewer, _ := newTestReviewer(t, "pro", map[string]fakeModel{
+				"pro": {text: finding, slowOn: "File: b.go", delay: time.Minute},
+			})
+			provider := &fakeProvider{diff: diff}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			err := runReview(ctx, provider, reviewer, "title", "", reviewOptions{PartialResults: tt.partial, TimeoutSeconds: 1})
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Fatalf("runReview took %v, the timeout didn't cancel the slow request", elapsed)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+				t.Errorf("err = %v, want a deadline error", err)
+			}
+			if len(provider.posted) != tt.wantPosted {
+				t.Fatalf("posted %d reviews, want %d", len(provider.posted), tt.wantPosted)
+			}
+			if tt.wantPosted > 0 {
+				posted := provider.posted[0]
+				if len(posted.comments) != 1 || posted.comments[0].Path != "a.go" || posted.conclusion != conclusionNeutral ||
+					!strings.Contains(posted.body, "the 1 second timeout was reached") {
+					t.Errorf("posted %+v, want the a.go finding with the timeout note", posted)
+				}
+			}
+		})
+	}
+}
+
+func TestRunReviewInlineMinSeverity(t *testing.T) {
+	t.Setenv("GITHUB_STEP_SUMMARY", "")
+	mixed := `[{"severity":"critical","comment":"Nil dereference","line":1},{"severity":"info","comment":"Rename the variable","line":1}]`
+	reviewer, _ := newTestReviewer(t, "pro", map[string]fakeModel{"pro": {text: mixed}})
+	provider := &fakeProvider{diff: addedFileDiff("a.go", "x.run()")}
+
+	err := runReview(context.Background(), provider, reviewer, "title", "", reviewOptions{InlineMinSeverity: SeverityWarning})
+	if err != nil {
+		t.Fatalf("runReview: %v", err)
+	}
+	if len(provider.posted) != 1 {
+		t.Fatalf("posted %d reviews, want 1", len(provider.posted))
+	}
+	posted := provider.posted[0]
+	if len(posted.comments) != 1 || posted.comments[0].Severity != SeverityCritical {
+		t.Errorf("inline comments = %+v, want only the critical finding", posted.comments)
+	}
+	if !strings.Contains(posted.body, "<details>") || !strings.Contains(posted.body, "`a.go:1` (info) Rename the variable") {
+		t.Errorf("body = %q, want the info finding in a collapsed summary", posted.body)
+	}
+	if strings.Contains(posted.body, "Nil dereference") {
+		t.Errorf("body = %q, want the critical finding left inline only", posted.body)
+	}
+}
+
+func TestRunReviewPostFailureKeepsFindingsInSummary(t *testing.T) {
+	summary := filepath.Join(t.TempDir(), "summary.md")
+	t.Setenv("GITHUB_STEP_SUMMARY", summary)
+	reviewer, _ := newTestReviewer(t, "pro", map[string]fakeModel{"pro": {text: finding}})
+	provider := &fakeProvider{diff: addedFileDiff("a.go", "run()"), postErr: errors.New("GitHub API returned 502")}
+
+	err := runReview(context.Background(), provider, reviewer, "title", "", reviewOptions{})
+	if err == nil || !strings.Contains(err.Error(), "failed to post comments: GitHub API returned 502") {
+		t.Fatalf("err = %v, want the post failure", err)
+	}
+	data, err := os.ReadFile(summary)
+	if err != nil {
+		t.Fatalf("reading the step summary: %v", err)
+	}
+	for _, want := range []string{"### Gemini review (not posted)", "#### `a.go:1`\n\n**Warning:** Handle the error"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("step summary = %q, want it to contain %q", data, want)
+		}
+	}
+}
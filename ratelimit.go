@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter paces calls to at most qps per second, shared by every goroutine using it.
+// It is a token bucket holding a single token, so calls are evenly spaced rather than bursty.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time // earliest time the next call may start
+}
+
+// newRateLimiter returns a limiter for qps calls per second, or nil (no limit) when qps <= 0
+func newRateLimiter(qps float64) *rateLimiter {
+	if qps <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / qps)}
+}
+
+// Wait blocks until the caller may make its call, or ctx is done. A nil limiter never waits.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	return sleepContext(ctx, wait)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// repoConfigPath is the per-repository config file, see repoConfigSource for which commit it is read from
+const repoConfigPath = ".gemini-review.yml"
+
+// RepoConfig holds the review settings that can be committed in the repository.
+// Zero values mean unset.
+type RepoConfig struct {
+	Exclude     []string `yaml:"exclude"`
+	MinSeverity string   `yaml:"min_severity"`
+	Model       string   `yaml:"model"`
+	MaxFiles    int      `yaml:"max_files"`
+}
+
+// parseRepoConfig decodes a config file, rejecting unknown keys so typos don't go unnoticed
+func parseRepoConfig(data []byte) (*RepoConfig, error) {
+	config := &RepoConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid %s: %v", repoConfigPath, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", repoConfigPath, err)
+	}
+	return config, nil
+}
+
+func (c *RepoConfig) validate() error {
+	if c.MinSeverity != "" {
+		severity := strings.ToLower(strings.TrimSpace(c.MinSeverity))
+		if severity != SeverityCritical && severity != SeverityWarning && severity != SeverityInfo {
+			return fmt.Errorf("min_severity must be %s, %s or %s, got %q", SeverityCritical, SeverityWarning, SeverityInfo, c.MinSeverity)
+		}
+		c.MinSeverity = severity
+	}
+	if c.MaxFiles < 0 {
+		return fmt.Errorf("max_files must not be negative, got %d", c.MaxFiles)
+	}
+	return nil
+}
+
+// repoConfigSource returns the repository and commit the config file is read from. PRs from
+// forks and pull_request_target runs read it from the base commit, so a PR can't weaken its own
+// review; other PRs come from people who can push to the repository and use their head commit.
+func repoConfigSource(prDetails *PRDetails, eventName string) (owner, repo, ref string) {
+	if prDetails.IsFork() || eventName == eventPullRequestTarget {
+		return prDetails.Owner, prDetails.Repo, prDetails.BaseSHA
+	}
+	return prDetails.HeadOwner, prDetails.HeadRepo, prDetails.HeadSHA
+}
+
+// loadRepoConfig fetches and parses the config file, nil when there is none. A failed fetch only
+// warns, the review goes on with the inputs; an invalid file is an error.
+func loadRepoConfig(ctx context.Context, client *GitHubClient, prDetails *PRDetails, eventName string) (*RepoConfig, error) {
+	owner, repo, ref := repoConfigSource(prDetails, eventName)
+	data, err := client.getFileContent(ctx, owner, repo, repoConfigPath, ref)
+	if err != nil {
+		fmt.Println("Warning:", err)
+		return nil, nil
+	}
+	if data == nil {
+		return nil, nil
+	}
+	config, err := parseRepoConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Loaded %s from %s/%s\n", repoConfigPath, owner, repo)
+	return config, nil
+}
+
+// readConfigInputs reads the action inputs that correspond to the config file keys
+func readConfigInputs() (*RepoConfig, error) {
+	inputs := &RepoConfig{
+		Exclude:     parseListInput(os.Getenv("INPUT_EXCLUDE")),
+		MinSeverity: os.Getenv("INPUT_MIN_SEVERITY"),
+		Model:       normalizeModelName(os.Getenv("INPUT_GEMINI_MODEL")),
+	}
+	// The legacy variable counts as set too, only the built-in default yields to the file
+	if inputs.Model == "" {
+		inputs.Model = normalizeModelName(os.Getenv("GEMINI_MODEL"))
+	}
+	if value := strings.TrimSpace(os.Getenv("INPUT_MAX_FILES")); value != "" {
+		maxFiles, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for INPUT_MAX_FILES: %q is not an integer", value)
+		}
+		inputs.MaxFiles = maxFiles
+	}
+	if err := inputs.validate(); err != nil {
+		return nil, err
+	}
+	return inputs, nil
+}
+
+// mergeRepoConfig resolves the settings from the config file and the action inputs.
+// Every input that is set wins over the file; file may be nil when there is no config file.
+func mergeRepoConfig(file, inputs *RepoConfig) RepoConfig {
+	merged := RepoConfig{}
+	if file != nil {
+		merged = *file
+	}
+	if len(inputs.Exclude) > 0 {
+		merged.Exclude = inputs.Exclude
+	}
+	if inputs.MinSeverity != "" {
+		merged.MinSeverity = inputs.MinSeverity
+	}
+	if inputs.Model != "" {
+		merged.Model = inputs.Model
+	}
+	if inputs.MaxFiles > 0 {
+		merged.MaxFiles = inputs.MaxFiles
+	}
+	return merged
+}
+
+// filterBySeverity drops the comments less severe than minSeverity, keeping all when it's empty
+func filterBySeverity(comments []Comment, minSeverity string) []Comment {
+	if minSeverity == "" {
+		return comments
+	}
+	var kept []Comment
+	for _, comment := range comments {
+		if severityRank(comment.Severity) >= severityRank(minSeverity) {
+			kept = append(kept, comment)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRepoConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    *RepoConfig
+		wantErr bool
+	}{
+		{
+			name: "all keys",
+			data: "exclude:\n  - vendor/**\nmin_severity: Warning\nmodel: gemini-2.5-pro\nmax_files: 20\n",
+			want: &RepoConfig{Exclude: []string{"vendor/**"}, MinSeverity: SeverityWarning, Model: "gemini-2.5-pro", MaxFiles: 20},
+		},
+		{name: "empty file", data: "", want: &RepoConfig{}},
+		{name: "unknown key", data: "min_severty: info\n", wantErr: true},
+		{name: "invalid severity", data: "min_severity: high\n", wantErr: true},
+		{name: "negative max files", data: "max_files: -1\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRepoConfig([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRepoConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeRepoConfig(t *testing.T) {
+	file := &RepoConfig{Exclude: []string{"docs/**"}, MinSeverity: SeverityInfo, Model: "gemini-2.5-pro", MaxFiles: 10}
+	tests := []struct {
+		name   string
+		file   *RepoConfig
+		inputs *RepoConfig
+		want   RepoConfig
+	}{
+		{"no config file", nil, &RepoConfig{MinSeverity: SeverityWarning}, RepoConfig{MinSeverity: SeverityWarning}},
+		{"unset inputs keep the file", file, &RepoConfig{}, *file},
+		{
+			name:   "set inputs win",
+			file:   file,
+			inputs: &RepoConfig{Exclude: []string{"gen/**"}, Model: "gemini-2.5-flash", MaxFiles: 3},
+			want:   RepoConfig{Exclude: []string{"gen/**"}, MinSeverity: SeverityInfo, Model: "gemini-2.5-flash", MaxFiles: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeRepoConfig(tt.file, tt.inputs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeRepoConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigInputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    *RepoConfig
+		wantErr bool
+	}{
+		{
+			name: "inputs",
+			env:  map[string]string{"INPUT_EXCLUDE": "a/**, b/**", "INPUT_MIN_SEVERITY": "critical", "INPUT_MAX_FILES": "5"},
+			want: &RepoConfig{Exclude: []string{"a/**", "b/**"}, MinSeverity: SeverityCritical, MaxFiles: 5},
+		},
+		{
+			name: "legacy model variable",
+			env:  map[string]string{"GEMINI_MODEL": "gemini-2.5-pro"},
+			want: &RepoConfig{Model: normalizeModelName("gemini-2.5-pro")},
+		},
+		{
+			name: "input model wins over the legacy variable",
+			env:  map[string]string{"INPUT_GEMINI_MODEL": "gemini-2.5-flash", "GEMINI_MODEL": "gemini-2.5-pro"},
+			want: &RepoConfig{Model: normalizeModelName("gemini-2.5-flash")},
+		},
+		{name: "max files not a number", env: map[string]string{"INPUT_MAX_FILES": "many"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"INPUT_EXCLUDE", "INPUT_MIN_SEVERITY", "INPUT_GEMINI_MODEL", "GEMINI_MODEL", "INPUT_MAX_FILES"} {
+				t.Setenv(key, tt.env[key])
+			}
+			got, err := readConfigInputs()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readConfigInputs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRepoConfig(t *testing.T) {
+	sameRepo := &PRDetails{Owner: "octo", Repo: "app", HeadOwner: "octo", HeadRepo: "app", HeadSHA: "head", BaseSHA: "base"}
+	fork := &PRDetails{Owner: "octo", Repo: "app", HeadOwner: "someone", HeadRepo: "app", HeadSHA: "head", BaseSHA: "base"}
+	tests := []struct {
+		name      string
+		pr        *PRDetails
+		eventName string
+		files     map[string]string // config file served by repository path and ref
+		want      *RepoConfig
+		wantFetch string
+		wantErr   bool
+	}{
+		{
+			name:      "same repository reads the head commit",
+			pr:        sameRepo,
+			eventName: eventPullRequest,
+			files:     map[string]string{"/repos/octo/app@head": "max_files: 3\n"},
+			want:      &RepoConfig{MaxFiles: 3},
+			wantFetch: "/repos/octo/app@head",
+		},
+		{
+			name:      "fork reads the base commit",
+			pr:        fork,
+			eventName: eventPullRequest,
+			files:     map[string]string{"/repos/octo/app@base": "max_files: 3\n", "/repos/someone/app@head": "max_files: 1\n"},
+			want:      &RepoConfig{MaxFiles: 3},
+			wantFetch: "/repos/octo/app@base",
+		},
+		{
+			name:      "pull_request_target reads the base commit",
+			pr:        sameRepo,
+			eventName: eventPullRequestTarget,
+			files:     map[string]string{"/repos/octo/app@base": "min_severity: info\n", "/repos/octo/app@head": "min_severity: critical\n"},
+			want:      &RepoConfig{MinSeverity: SeverityInfo},
+			wantFetch: "/repos/octo/app@base",
+		},
+		{
+			name:      "no config file",
+			pr:        fork,
+			eventName: eventPullRequest,
+			files:     map[string]string{"/repos/someone/app@head": "max_files: 1\n"},
+			wantFetch: "/repos/octo/app@base",
+		},
+		{
+			name:      "invalid config file",
+			pr:        sameRepo,
+			eventName: eventPullRequest,
+			files:     map[string]string{"/repos/octo/app@head": "max_file: 1\n"},
+			wantFetch: "/repos/octo/app@head",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetched []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				repo, path, _ := strings.Cut(r.URL.Path, "/contents/")
+				if path != repoConfigPath {
+					t.Errorf("fetched %s, want %s", r.URL.Path, repoConfigPath)
+				}
+				key := repo + "@" + r.URL.Query().Get("ref")
+				fetched = append(fetched, key)
+				if data, ok := tt.files[key]; ok {
+					w.Write([]byte(data))
+					return
+				}
+				http.NotFound(w, r)
+			}))
+			defer srv.Close()
+
+			client := NewGitHubClient("token", srv.Client())
+			client.BaseURL = srv.URL
+			got, err := loadRepoConfig(context.Background(), client, tt.pr, tt.eventName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadRepoConfig() = %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(fetched, []string{tt.wantFetch}) {
+				t.Errorf("fetched %v, want %s", fetched, tt.wantFetch)
+			}
+		})
+	}
+}
+
+func TestLoadRepoConfigFetchFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	client := NewGitHubClient("token", srv.Client())
+	client.BaseURL = srv.URL
+	pr := &PRDetails{Owner: "octo", Repo: "app", HeadOwner: "octo", HeadRepo: "app"}
+	if got, err := loadRepoConfig(context.Background(), client, pr, eventPullRequest); got != nil || err != nil {
+		t.Errorf("loadRepoConfig() = %+v, %v, want the review to go on without a config", got, err)
+	}
+}
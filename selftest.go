@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// runSelfTest checks that the GitHub credentials and the Gemini API key work, printing OK or FAIL
+// for each, without reviewing anything. It returns an error when any check fails.
+func runSelfTest(ctx context.Context, w io.Writer, github *GitHubClient, appID, appPrivateKey string, gemini *GeminiClient, model string) error {
+	failed := false
+
+	if identity, err := checkGitHubAuth(ctx, github, appID, appPrivateKey); err != nil {
+		fmt.Fprintf(w, "GitHub: FAIL (%v)\n", err)
+		failed = true
+	} else {
+		fmt.Fprintf(w, "GitHub: OK (%s)\n", identity)
+	}
+
+	if err := checkGemini(ctx, gemini, model); err != nil {
+		fmt.Fprintf(w, "Gemini: FAIL (%v)\n", err)
+		failed = true
+	} else {
+		fmt.Fprintf(w, "Gemini: OK (model %s)\n", model)
+	}
+
+	if failed {
+		return errors.New("self-test failed")
+	}
+	return nil
+}
+
+// errGeminiAuth is returned by checkGemini when the API key or credentials are rejected
+var errGeminiAuth = errors.New("gemini rejected the credentials")
+
+// checkGemini makes a trivial Gemini call, telling rejected credentials, an unknown model and an
+// unreachable endpoint apart
+func checkGemini(ctx context.Context, client *GeminiClient, model string) error {
+	_, err := client.GenerateContent(ctx, model, "", "Reply with OK.", nil)
+	var apiErr *GeminiAPIError
+	var urlErr *url.Error
+	var blocked *BlockedError
+	switch {
+	case err == nil, errors.As(err, &blocked):
+		// A blocked answer still means the request was accepted
+		return nil
+	case errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode == http.StatusServiceUnavailable):
+		// The credentials were accepted, the review retries or falls back on its own
+		return nil
+	case errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden ||
+		apiErr.StatusCode == http.StatusBadRequest && strings.Contains(apiErr.Body, "API_KEY_INVALID")):
+		return fmt.Errorf("%w, check INPUT_GEMINI_API_KEY or the Vertex AI credentials: %v", errGeminiAuth, err)
+	case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("gemini model %s not found: %v", model, err)
+	case errors.As(err, &urlErr):
+		return fmt.Errorf("could not reach the Gemini API: %v", err)
+	default:
+		return err
+	}
+}
+
+// checkGitHubAuth makes an authenticated call and describes who the credentials belong to
+func checkGitHubAuth(ctx context.Context, c *GitHubClient, appID, appPrivateKey string) (string, error) {
+	if appID != "" {
+		appJWT, err := createAppJWT(appID, appPrivateKey, time.Now())
+		if err != nil {
+			return "", err
+		}
+		var app struct {
+			Slug string `json:"slug"`
+		}
+		if err := c.doAppRequest(ctx, "GET", c.BaseURL+"/app", appJWT, http.StatusOK, &app); err != nil {
+			return "", err
+		}
+		return "GitHub App " + app.Slug, nil
+	}
+
+	var user struct {
+		Login string `json:"login"`
+	}
+	err := c.doJSON(ctx, "GET", c.BaseURL+"/user", nil, http.StatusOK, &user)
+	if err == nil {
+		return "authenticated as " + user.Login, nil
+	}
+
+	// Installation tokens such as the workflow's GITHUB_TOKEN can't read /user
+	var installation struct {
+		TotalCount int `json:"total_count"`
+	}
+	if installErr := c.doJSON(ctx, "GET", c.BaseURL+"/installation/repositories?per_page=1", nil, http.StatusOK, &installation); installErr != nil {
+		return "", err
+	}
+	return fmt.Sprintf("installation token with access to %d repositories", installation.TotalCount), nil
+}
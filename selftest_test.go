@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckGemini(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		wantAuth bool
+		wantErr  string
+	}{
+		{name: "ok", status: http.StatusOK, body: `{"candidates":[]}`},
+		{name: "overloaded", status: http.StatusServiceUnavailable},
+		{name: "rate limited", status: http.StatusTooManyRequests},
+		{name: "unauthorized", status: http.StatusUnauthorized, wantAuth: true},
+		{name: "forbidden", status: http.StatusForbidden, wantAuth: true},
+		{name: "invalid key", status: http.StatusBadRequest, body: `{"error":{"details":[{"reason":"API_KEY_INVALID"}]}}`, wantAuth: true},
+		{name: "unknown model", status: http.StatusNotFound, wantErr: "gemini model pro not found"},
+		{name: "bad request", status: http.StatusBadRequest, body: "bad", wantErr: "400"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			client := NewGeminiClient("key", srv.Client())
+			client.BaseURL = srv.URL
+
+			err := checkGemini(context.Background(), client, "pro")
+			if got := errors.Is(err, errGeminiAuth); got != tt.wantAuth {
+				t.Errorf("err = %v, auth error %v, want %v", err, got, tt.wantAuth)
+			}
+			if tt.wantErr == "" && !tt.wantAuth && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckGeminiUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	client := NewGeminiClient("key", srv.Client())
+	client.BaseURL = srv.URL
+	srv.Close()
+
+	err := checkGemini(context.Background(), client, "pro")
+	if err == nil || errors.Is(err, errGeminiAuth) || !strings.Contains(err.Error(), "could not reach the Gemini API") {
+		t.Errorf("err = %v, want a network error", err)
+	}
+}
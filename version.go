@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is the release of the action, set at build time with
+// go build -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// versionString describes the running build: the version, the commit when the binary was built
+// from a git checkout, and the Go version
+func versionString() string {
+	s := "gemini-review " + version
+	if info, ok := debug.ReadBuildInfo(); ok {
+		revision, modified := "", false
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if len(revision) > 12 {
+			revision = revision[:12]
+		}
+		if revision != "" {
+			if modified {
+				revision += "-dirty"
+			}
+			s += fmt.Sprintf(" (%s)", revision)
+		}
+	}
+	return s + " " + runtime.Version()
+}